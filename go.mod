@@ -3,8 +3,15 @@ module bergelmir
 go 1.19
 
 require (
+	filippo.io/edwards25519 v1.0.0
+	github.com/andybalholm/brotli v1.0.6
 	golang.org/x/crypto v0.1.0
+	golang.org/x/term v0.1.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require golang.org/x/sys v0.1.0 // indirect
+require (
+	golang.org/x/net v0.1.0 // indirect
+	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/text v0.4.0 // indirect
+)
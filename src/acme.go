@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	ACME_CHALLENGE_HTTP_01     = "http-01"
+	ACME_CHALLENGE_TLS_ALPN_01 = "tls-alpn-01"
+	HTTPS_DEFAULT_PORT         = 443
+)
+
+var (
+	acmeManager     *autocert.Manager
+	acmeManagerLock sync.RWMutex
+)
+
+// Get the domain names to request ACME certificates for.  Defaults to the
+// Gemini capsule domain names that can be reached from the internet
+func getACMEDomainList() []string {
+	return acmeDomainList(getConfig())
+}
+
+// Get the domain names to request ACME certificates for by config
+func acmeDomainList(config Config) (domainList []string) {
+	if len(config.HTTP.HTTPS.ACME.DomainNames) > 0 {
+		return append(domainList, config.HTTP.HTTPS.ACME.DomainNames...)
+	}
+	for _, domain := range config.Gemini.DomainNames {
+		if isPublicDomain(domain) {
+			domainList = append(domainList, strings.ToLower(domain))
+		}
+	}
+	return
+}
+
+// Check if a certificate for domain could be requested from an ACME CA
+func isPublicDomain(domain string) bool {
+	domain = strings.ToLower(domain)
+	return domain != "localhost" && !strings.HasSuffix(domain, ".onion") &&
+		net.ParseIP(domain) == nil
+}
+
+// Create the ACME certificate manager for the HTTPS server from the https
+// values in config
+func newACMEManager(config Config) (*autocert.Manager, error) {
+	acmeConfig := config.HTTP.HTTPS.ACME
+	domainList := acmeDomainList(config)
+	if len(domainList) == 0 {
+		return nil, fmt.Errorf("no domain names to request ACME " +
+			"certificates for")
+	}
+	if err := os.MkdirAll(acmeConfig.CachePath, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create ACME cache directory: %w",
+			err)
+	}
+	client := &acme.Client{DirectoryURL: acmeConfig.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if acmeConfig.DirectoryCAPath != "" {
+		// Trust an extra CA for the ACME directory, such as the root
+		// certificate of a local Pebble instance
+		httpClient, err := newACMEHTTPClient(acmeConfig.DirectoryCAPath)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+	}
+	return &autocert.Manager{
+		Prompt: func(tosURL string) bool {
+			return acmeConfig.AcceptTermsOfService
+		},
+		Cache:      autocert.DirCache(acmeConfig.CachePath),
+		HostPolicy: autocert.HostWhitelist(domainList...),
+		Client:     client,
+		Email:      acmeConfig.Email,
+	}, nil
+}
+
+// Create HTTP client for the ACME directory that trusts the PEM encoded CA
+// certificates at caPath along with the system CA certificates
+func newACMEHTTPClient(caPath string) (*http.Client, error) {
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ACME directory CA file: %w",
+			err)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in ACME directory CA file %s",
+			caPath)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Wrap the plain HTTP server handler to answer ACME http-01 challenges and
+// redirect HTTPS domain requests to the HTTPS server if enabled
+func acmeHTTPHandler(handler http.Handler) http.Handler {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isACMEDomain(r.Host) {
+			// Requests over tor or to other hosts stay on plain HTTP
+			handler.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, httpsURL(r), http.StatusMovedPermanently)
+	})
+	// The HTTPS settings are checked for every request, as they can change
+	// when the config is reloaded
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		https := getConfig().HTTP.HTTPS
+		if !https.Enabled {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		fallback := handler
+		if https.RedirectHTTP {
+			fallback = redirect
+		}
+		if https.ACME.Challenge != ACME_CHALLENGE_HTTP_01 {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		getACMEManager().HTTPHandler(fallback).ServeHTTP(w, r)
+	})
+}
+
+// Replace the ACME certificate manager
+func setACMEManager(manager *autocert.Manager) {
+	acmeManagerLock.Lock()
+	defer acmeManagerLock.Unlock()
+	acmeManager = manager
+}
+
+// Get the ACME certificate manager
+func getACMEManager() *autocert.Manager {
+	acmeManagerLock.RLock()
+	defer acmeManagerLock.RUnlock()
+	return acmeManager
+}
+
+// Get the TLS config of the HTTPS server.  Certificates come from the
+// current ACME certificate manager, which answers tls-alpn-01 challenges
+func acmeTLSConfig() *tls.Config {
+	tlsConfig := getACMEManager().TLSConfig()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return getACMEManager().GetCertificate(hello)
+	}
+	return tlsConfig
+}
+
+// Check if host (with or without port) is an ACME certificate domain
+func isACMEDomain(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, domain := range getACMEDomainList() {
+		if host == strings.ToLower(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the HTTPS URL of an HTTP request
+func httpsURL(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	_, location := parseLocation(getConfig().HTTP.HTTPS.ListeningLocation)
+	if _, port, err := net.SplitHostPort(location); err == nil &&
+		port != fmt.Sprint(HTTPS_DEFAULT_PORT) {
+		host = net.JoinHostPort(host, port)
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
@@ -8,57 +8,102 @@ import (
 )
 
 const (
-	VERSION = "0.0.1"
+	VERSION = "0.0.9"
 )
 
-func init() {
-	getFlags()
-	if flags.init {
-		initBergelmirProject()
-		os.Exit(0)
-	} else {
-		parseConfigData()
-	}
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
 
-func main() {
-	c := make(chan os.Signal)
+// Start the Gemini capsule, HTTP server and Tor and serve until SIGINT or
+// SIGTERM.  Returns the exit code
+func serve() int {
+	// An invalid config file is not migrated, so it can be fixed as written
+	if code := validateConfigFile(); code != EXIT_SUCCESS {
+		logError("Run `%s check` after fixing the config file", bergelmirCmd)
+		return code
+	}
+	if code, _ := migrateConfigFile(false); code != EXIT_SUCCESS {
+		return code
+	}
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	fmt.Println("Starting Bergelmir")
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	logInfo("Starting Bergelmir")
+	loadGeminiContent()
+	if configData.Gemini.SealedContentPath != "" {
+		logInfo("- Decrypted sealed Gemini content %s in memory",
+			configData.Gemini.SealedContentPath)
+	}
 	if configData.Tor.Enabled {
-		fmt.Println("- Starting Tor")
+		logInfo("- Starting Tor")
 		torConnected = make(chan bool)
 		startTor()
 		connectToTor()
 		<-torConnected
-		fmt.Println("- Tor started")
-		fmt.Printf("- Tor onion address is %s\n", torAddress)
+		logInfo("- Tor started")
+		logInfo("- Tor onion address is %s", getTorAddress())
 	}
-	fmt.Printf("- Starting Gemini capsule at gemini://%s\n", configData.Gemini.ListeningLocation)
-	go startGeminiServer()
+	logInfo("- Starting Gemini capsule at gemini://%s", configData.Gemini.ListeningLocation)
+	startGeminiServer()
 	// Show the Gemini capsule .onion address if tor is enabled
 	if configData.Tor.Enabled {
-		fmt.Printf("- Gemini capsule is accessible over tor at gemini://%s", torAddress)
+		onionLocation := getTorAddress()
 		// Only show port if not default Gemini port
 		if configData.Gemini.Tor.VirtualPort != GEMINI_DEFAULT_PORT {
-			fmt.Printf(":%d", configData.Gemini.Tor.VirtualPort)
+			onionLocation += fmt.Sprintf(":%d", configData.Gemini.Tor.VirtualPort)
 		}
-		fmt.Print("\n")
+		logInfo("- Gemini capsule is accessible over tor at gemini://%s",
+			onionLocation)
 	}
 	if configData.HTTP.Enabled {
-		fmt.Printf("- Starting HTTP server at http://%s\n", configData.HTTP.ListeningLocation)
+		if configData.HTTP.HTTPS.Enabled {
+			// Create ACME certificate manager before the HTTP server starts
+			// so it can answer http-01 challenges
+			manager, err := newACMEManager(configData)
+			handleErr(err, "Unable to create ACME certificate manager")
+			setACMEManager(manager)
+		}
+		logInfo("- Starting HTTP server at http://%s", configData.HTTP.ListeningLocation)
 		// Start the HTTP server
-		go startHTTPServer()
+		handleErr(startHTTPServer(), "Unable to start HTTP server")
 		// Show the HTTP server .onion address if tor is enabled
 		if configData.Tor.Enabled {
-			fmt.Printf("- HTTP server is accessible over tor at http://%s", torAddress)
+			onionLocation := getTorAddress()
 			// Only show port if not default HTTP port
 			if configData.HTTP.Tor.VirtualPort != HTTP_DEFAULT_PORT {
-				fmt.Printf(":%d", configData.HTTP.Tor.VirtualPort)
+				onionLocation += fmt.Sprintf(":%d", configData.HTTP.Tor.VirtualPort)
+			}
+			logInfo("- HTTP server is accessible over tor at http://%s",
+				onionLocation)
+		}
+		if configData.HTTP.HTTPS.Enabled {
+			logInfo("- Starting HTTPS server at https://%s",
+				configData.HTTP.HTTPS.ListeningLocation)
+			handleErr(startHTTPSServer(), "Unable to start HTTPS server")
+		}
+	}
+	for {
+		select {
+		case <-hup:
+			// Reload config without closing open connections
+			logInfo("- Received SIGHUP, reloading config file %s",
+				configFilePath)
+			reloadConfig()
+		case <-c:
+			// A second SIGINT or SIGTERM stops without waiting
+			result := make(chan int, 1)
+			go func() { result <- shutdown() }()
+			select {
+			case code := <-result:
+				return code
+			case <-c:
+				logWarn("- Received second signal, exiting without " +
+					"waiting for open connections")
+				killTor()
+				return EXIT_FAILURE
 			}
-			fmt.Print("\n")
 		}
 	}
-	//generateNewTLSCertAndKey()
-	<-c
 }
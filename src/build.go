@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Render the Gemini capsule to static HTML files in outputPath, along with
+// the HTTP data path files and the RSS feed for baseURL.  Returns the exit
+// code
+func buildStaticSite(outputPath, baseURL string) int {
+	loadGeminiContent()
+	pageCount, fileCount := 0, 0
+	content := getGeminiContent()
+	err := fs.WalkDir(content, ".", func(name string, d fs.DirEntry,
+		err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		extension := path.Ext(name)
+		if extension == ".gmi" || extension == ".gemini" {
+			urlPath := "/" + strings.TrimSuffix(name, extension)
+			htmlPage, exists, err := renderHTMLPage(urlPath, baseURL)
+			if err != nil || !exists {
+				return err
+			}
+			pageCount++
+			return writeBuildFile(outputPath, urlPath+".html", htmlPage)
+		}
+		f, err := content.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fileCount++
+		return copyBuildFile(outputPath, name, f)
+	})
+	if err != nil {
+		logError("Unable to render Gemini capsule: %s", err)
+		return EXIT_FAILURE
+	}
+	if configData.HTTP.DataPath != "" {
+		layoutPaths := map[string]bool{}
+		for _, file := range htmlLayoutFiles(configData) {
+			layoutPath, _ := filepath.Abs(file)
+			layoutPaths[layoutPath] = true
+		}
+		// Like handleHTTPFile, only the files the HTTP server serves
+		httpDataRoot := dataRoot(configData.HTTP.DataPath)
+		err = fs.WalkDir(httpDataRoot, ".", func(name string, d fs.DirEntry,
+			err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			filePath := filepath.Join(configData.HTTP.DataPath,
+				filepath.FromSlash(name))
+			if absPath, _ := filepath.Abs(filePath); layoutPaths[absPath] {
+				// The HTML layout and partials are already part of every
+				// page
+				return nil
+			}
+			if gf, err := openGeminiContentFile(name); err == nil {
+				// Gemini capsule files take precedence like in handleHTTPFile
+				gf.Close()
+				return nil
+			}
+			f, err := httpDataRoot.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fileCount++
+			return copyBuildFile(outputPath, name, f)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			logError("Unable to copy HTTP data path files: %s", err)
+			return EXIT_FAILURE
+		}
+	}
+	if configData.RSS.Enabled {
+		feed := createRSSFeed(baseURL)
+		for _, feedPath := range []string{"/feed", "/rss"} {
+			if err := writeBuildFile(outputPath, feedPath, []byte(feed)); err != nil {
+				logError("Unable to write RSS feed: %s", err)
+				return EXIT_FAILURE
+			}
+		}
+	}
+	// Generated files don't replace real files, like on the HTTP mirror.  The
+	// output path may still have the generated files of a previous build
+	generated := map[string]func() ([]byte, error){}
+	if configData.HTTP.SitemapEnabled {
+		generated[SITEMAP_PATH] = func() ([]byte, error) {
+			return generateSitemap(strings.TrimSuffix(baseURL, "/"), true)
+		}
+	}
+	generated["/robots.txt"] = func() ([]byte, error) {
+		sitemapURL := ""
+		if configData.HTTP.SitemapEnabled {
+			sitemapURL = strings.TrimSuffix(baseURL, "/") + SITEMAP_PATH
+		}
+		return []byte(generateRobotsTxt(ROBOTS_PROTOCOL_HTTP, sitemapURL)), nil
+	}
+	for _, name := range []string{SITEMAP_PATH, "/robots.txt"} {
+		if generated[name] == nil || sourceFileExists(name) {
+			continue
+		}
+		content, err := generated[name]()
+		if err == nil && len(content) > 0 {
+			err = writeBuildFile(outputPath, name, content)
+		}
+		if err != nil {
+			logError("Unable to write %s: %s", name, err)
+			return EXIT_FAILURE
+		}
+	}
+	logInfo("- Rendered %d pages and copied %d files to %s", pageCount,
+		fileCount, outputPath)
+	return EXIT_SUCCESS
+}
+
+// Check if there is a file at URL path urlPath in the Gemini capsule
+// content or the HTTP data path, like handleHTTPFile
+func sourceFileExists(urlPath string) bool {
+	if f, err := openGeminiContentFile(urlPath); err == nil {
+		f.Close()
+		return true
+	}
+	if configData.HTTP.DataPath == "" {
+		return false
+	}
+	info, err := fs.Stat(dataRoot(configData.HTTP.DataPath),
+		contentName(urlPath))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Write content to name in outputPath
+func writeBuildFile(outputPath, name string, content []byte) error {
+	filePath := filepath.Join(outputPath, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, content, 0644)
+}
+
+// Copy the content of r to name in outputPath
+func copyBuildFile(outputPath, name string, r io.Reader) error {
+	filePath := filepath.Join(outputPath, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Get the base URL of a static build, http.base_url or else the first
+// public Gemini domain name over https.  Returns "" if there is neither
+func defaultBuildBaseURL() string {
+	if configData.HTTP.BaseURL != "" {
+		return configData.HTTP.BaseURL
+	}
+	for _, domain := range configData.Gemini.DomainNames {
+		if isPublicDomain(domain) {
+			return "https://" + domain
+		}
+	}
+	return ""
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default Cache-Control header values by content type.  Pages can change
+// at any time, so they are revalidated with their ETag
+var defaultHTTPCacheControl = map[string]string{
+	"text/html":            "no-cache",
+	"application/rss+xml":  "no-cache",
+	"application/atom+xml": "no-cache",
+	"*":                    "public, max-age=3600",
+}
+
+const (
+	// Most sizes of generated responses that are remembered
+	GENERATED_SIZES_MAX = 4096
+)
+
+var (
+	// Sizes of generated responses by ETag, so the content encoding variant
+	// of a 304 Not Modified response is known without generating it again
+	generatedSizes     = map[string]int64{}
+	generatedSizesLock sync.Mutex
+)
+
+// Get the size of the generated response with etag, if it was generated
+func getGeneratedSize(etag string) (size int64, known bool) {
+	generatedSizesLock.Lock()
+	defer generatedSizesLock.Unlock()
+	size, known = generatedSizes[etag]
+	return
+}
+
+// Remember the size of the generated response with etag
+func setGeneratedSize(etag string, size int64) {
+	if etag == "" {
+		return
+	}
+	generatedSizesLock.Lock()
+	defer generatedSizesLock.Unlock()
+	if len(generatedSizes) >= GENERATED_SIZES_MAX {
+		generatedSizes = map[string]int64{}
+	}
+	generatedSizes[etag] = size
+}
+
+// Get the ETag of a file from its modification time and size
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+// Get the ETag and last modification time of a page generated from the
+// files of infos and extra, such as the default page title
+func generatedETag(infos []fs.FileInfo, extra ...string) (etag string,
+	modTime time.Time) {
+	hash := sha256.New()
+	for _, info := range infos {
+		fmt.Fprintf(hash, "%s|%d|%d|", info.Name(), info.ModTime().UnixNano(),
+			info.Size())
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	for _, s := range extra {
+		fmt.Fprintf(hash, "%s|", s)
+	}
+	return fmt.Sprintf("\"%x\"", hash.Sum(nil)[:16]), modTime
+}
+
+// Get the validators of the HTML page rendered from the Gemtext page at URL
+// path url for baseURL, from the Gemtext files of the page and its
+// breadcrumbs, the HTML layout and its partials
+func htmlPageETag(url, baseURL string) (etag string, modTime time.Time,
+	exists bool) {
+	sourceInfo, exists := statGemtextFile(url)
+	if !exists {
+		return
+	}
+	config := getConfig()
+	infos := []fs.FileInfo{sourceInfo}
+	for _, breadcrumb := range getBreadcrumbs(url) {
+		for _, source := range []string{breadcrumb.URL, breadcrumb.URL +
+			"/index"} {
+			if info, exists := statGemtextFile(source); exists {
+				infos = append(infos, info)
+			}
+		}
+	}
+	// Previous and next post links come from the gemlog page
+	if info, exists := statGemtextFile(
+		config.RSS.FeedSourceGeminiPath); exists {
+		infos = append(infos, info)
+	}
+	infos = append(infos, htmlLayoutFileInfos(config)...)
+	etag, modTime = generatedETag(infos, config.HTTP.DefaultPageTitle,
+		getHTTPBaseURL(baseURL), getTorAddress(),
+		fmt.Sprint(config.RSS.Enabled, config.HTTP.Links))
+	return
+}
+
+// Get the Cache-Control header value for contentType from the config
+func getCacheControl(contentType string) string {
+	cacheControl := getConfig().HTTP.CacheControl
+	if len(cacheControl) == 0 {
+		cacheControl = defaultHTTPCacheControl
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	if value, ok := cacheControl[mediaType]; ok {
+		return value
+	}
+	if i := strings.Index(mediaType, "/"); i > 0 {
+		if value, ok := cacheControl[mediaType[:i]+"/*"]; ok {
+			return value
+		}
+	}
+	return cacheControl["*"]
+}
+
+// Set the ETag, Last-Modified and Cache-Control headers of a response
+func setCacheHeaders(w http.ResponseWriter, contentType, etag string,
+	modTime time.Time) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if cacheControl := getCacheControl(contentType); cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+}
+
+// Check if the client already has the response with etag and modTime from
+// the If-None-Match or If-Modified-Since request headers.  If-None-Match
+// takes precedence
+func isNotModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			// Compressed variants match the uncompressed ETag
+			tag = decodedETag(strings.TrimPrefix(strings.TrimSpace(tag), "W/"))
+			if tag == "*" || (etag != "" &&
+				tag == decodedETag(strings.TrimPrefix(etag, "W/"))) {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	// Last-Modified has a resolution of seconds
+	return err == nil && !modTime.Truncate(time.Second).After(t)
+}
+
+// Set the cache headers and send 304 Not Modified if the client already has
+// the response.  Returns true if the response was sent
+func handleNotModified(w http.ResponseWriter, r *http.Request,
+	contentType, etag string, modTime time.Time) bool {
+	setCacheHeaders(w, contentType, etag, modTime)
+	if !isNotModified(r, etag, modTime) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
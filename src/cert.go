@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Run `bergelmir cert <subcommand>` and return the exit code
+func runCertCommand(subcommand string) int {
+	switch subcommand {
+	case "info":
+		return printTLSCertInfo()
+	case "regenerate":
+		// Replace TLS key and TLS certificate even if they are valid
+		if err := regenerateTLSCertAndKey(); err != nil {
+			logError("Unable to regenerate TLS certificate: %s", err)
+			return EXIT_FAILURE
+		}
+		return EXIT_SUCCESS
+	default:
+		fmt.Printf("Usage: %s cert <subcommand>\n\n", bergelmirCmd)
+		fmt.Println("Subcommands:")
+		fmt.Println("  info        Show the TLS certificate domain names, " +
+			"validity, key type and fingerprints")
+		fmt.Println("  regenerate  Generate a new TLS private key of the " +
+			"configured key type and a new self-signed TLS certificate")
+		if subcommand != "help" {
+			return EXIT_USAGE
+		}
+		return EXIT_SUCCESS
+	}
+}
+
+// Print the config TLS certificate details and the SHA-256 fingerprints
+// Gemini clients show for trust on first use.  Returns the exit code
+func printTLSCertInfo() int {
+	certPEM, err := os.ReadFile(configData.Gemini.TLS.CertPath)
+	if err != nil {
+		logError("Unable to read TLS certificate file %s",
+			configData.Gemini.TLS.CertPath)
+		return EXIT_FAILURE
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		logError("Unable to find PEM encoded TLS certificate in %s",
+			configData.Gemini.TLS.CertPath)
+		return EXIT_FAILURE
+	}
+	x509Cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		logError("Unable to parse TLS certificate %s: %s",
+			configData.Gemini.TLS.CertPath, err)
+		return EXIT_FAILURE
+	}
+	fmt.Printf("Certificate:  %s\n", configData.Gemini.TLS.CertPath)
+	fmt.Printf("Subject:      %s\n", x509Cert.Subject.String())
+	fmt.Printf("Issuer:       %s\n", x509Cert.Issuer.String())
+	fmt.Println("Domain names:")
+	for _, domain := range x509Cert.DNSNames {
+		fmt.Printf("  %s\n", domain)
+	}
+	for _, ip := range x509Cert.IPAddresses {
+		fmt.Printf("  %s\n", ip.String())
+	}
+	fmt.Printf("Not before:   %s\n", x509Cert.NotBefore.UTC().Format(time.RFC3339))
+	fmt.Printf("Not after:    %s\n", x509Cert.NotAfter.UTC().Format(time.RFC3339))
+	fmt.Printf("Key type:     %s\n", tlsPublicKeyType(x509Cert.PublicKey))
+	certSum := sha256.Sum256(x509Cert.Raw)
+	spkiSum := sha256.Sum256(x509Cert.RawSubjectPublicKeyInfo)
+	fmt.Println("Certificate SHA-256 fingerprint:")
+	printFingerprint(certSum[:])
+	fmt.Println("Public key (SPKI) SHA-256 fingerprint:")
+	printFingerprint(spkiSum[:])
+	return printTLSCertWarnings(x509Cert)
+}
+
+// Print fingerprint as colon separated uppercase hex, lowercase hex and
+// base64, the formats Gemini clients commonly show
+func printFingerprint(sum []byte) {
+	hexSum := strings.ToUpper(hex.EncodeToString(sum))
+	colonHexSum := ""
+	for i := 0; i < len(hexSum); i += 2 {
+		if i > 0 {
+			colonHexSum += ":"
+		}
+		colonHexSum += hexSum[i : i+2]
+	}
+	fmt.Printf("  %s\n", colonHexSum)
+	fmt.Printf("  %s\n", strings.ToLower(hexSum))
+	fmt.Printf("  %s\n", base64.StdEncoding.EncodeToString(sum))
+}
+
+// Print warnings about a TLS certificate that doesn't match configData.
+// Returns 1 if there were warnings, otherwise 0
+func printTLSCertWarnings(x509Cert *x509.Certificate) int {
+	warnings := []string{}
+	now := time.Now()
+	switch {
+	case now.After(x509Cert.NotAfter):
+		warnings = append(warnings, "TLS certificate has expired")
+	case now.Before(x509Cert.NotBefore):
+		warnings = append(warnings, "TLS certificate is not valid yet")
+	case tlsCertExpiresSoon(x509Cert):
+		warnings = append(warnings, fmt.Sprintf("TLS certificate expires "+
+			"soon, use `%s cert regenerate` to replace it", bergelmirCmd))
+	}
+	// The onion address is only known when tor is running, so any .onion
+	// certificate domain name is accepted when tor is enabled
+	for _, domain := range getDomainList() {
+		if !domainInSlice(domain, x509Cert.DNSNames) {
+			warnings = append(warnings, fmt.Sprintf("Domain name %s is not "+
+				"in the TLS certificate", domain))
+		}
+	}
+	for _, certDomain := range x509Cert.DNSNames {
+		if configData.Tor.Enabled &&
+			strings.HasSuffix(strings.ToLower(certDomain), ".onion") {
+			continue
+		}
+		if !domainInSlice(certDomain, getDomainList()) {
+			warnings = append(warnings, fmt.Sprintf("TLS certificate domain "+
+				"name %s is not a configured domain name", certDomain))
+		}
+	}
+	// tls.X509KeyPair has no error value for a key that doesn't match
+	if _, err := loadTLSKeyPair(); err != nil && err.Error() ==
+		"tls: private key does not match public key" {
+		warnings = append(warnings, fmt.Sprintf("TLS private key %s does not "+
+			"match the TLS certificate", configData.Gemini.TLS.KeyPath))
+	} else if err != nil {
+		warnings = append(warnings, fmt.Sprintf("Unable to load TLS private "+
+			"key %s: %s", configData.Gemini.TLS.KeyPath, err))
+	}
+	if len(warnings) == 0 {
+		return EXIT_SUCCESS
+	}
+	logWarn("Warnings:")
+	for _, warning := range warnings {
+		logWarn("  %s", warning)
+	}
+	logWarn("A new TLS certificate is generated from the TLS private key " +
+		"at the next start or reload when the domain names don't match")
+	return EXIT_FAILURE
+}
+
+// Get the TLS key type of pubKey (ed25519, ecdsa-p256, rsa-2048, etc.)
+func tlsPublicKeyType(pubKey any) string {
+	switch key := pubKey.(type) {
+	case ed25519.PublicKey:
+		return TLS_KEY_TYPE_ED25519
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(
+			strings.ReplaceAll(key.Curve.Params().Name, "-", ""))
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", key.N.BitLen())
+	default:
+		return "unknown"
+	}
+}
+
+// Check if domain name domain is in list.  Domain names are case
+// insensitive
+func domainInSlice(domain string, list []string) bool {
+	for _, item := range list {
+		if strings.EqualFold(domain, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if s is in list
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A problem found in the config file.  key is the dotted YAML key of the
+// config field, such as gemini.listening_location.  Warnings don't stop
+// bergelmir from starting
+type configProblem struct {
+	key     string
+	line    int
+	message string
+	warning bool
+}
+
+// A listening location of a server, used to find clashing locations
+type configListener struct {
+	key     string
+	network string
+	host    string
+	port    string
+}
+
+// Validate the config file and print every problem.  Returns the exit code
+func checkConfig() int {
+	if code := loadConfigForCLI(); code != EXIT_SUCCESS {
+		return code
+	}
+	if code := validateConfigFile(); code != EXIT_SUCCESS {
+		return code
+	}
+	fmt.Printf("Config file %s is valid\n", configFilePath)
+	return EXIT_SUCCESS
+}
+
+// Validate the config file and log every problem with the config file line
+// it was found on.  Returns the exit code
+func validateConfigFile() int {
+	content, err := os.ReadFile(configFilePath)
+	if err != nil {
+		logError("Unable to read config file %s: %s", configFilePath, err)
+		return EXIT_CONFIG
+	}
+	problems := validateConfig(configData)
+	// Unknown fields are usually typos of a field name
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.SetStrict(true)
+	var typeErr *yaml.TypeError
+	if err := decoder.Decode(&Config{}); errors.As(err, &typeErr) {
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, parseYAMLProblem(msg))
+		}
+	}
+	if len(problems) == 0 {
+		return EXIT_SUCCESS
+	}
+	errorCount := countConfigErrors(problems)
+	lines := strings.Split(string(content), "\n")
+	if errorCount > 0 {
+		logError("Found %d problem(s) in config file %s:", errorCount,
+			configFilePath)
+	}
+	for _, problem := range problems {
+		line := problem.line
+		if line == 0 {
+			line = configKeyLine(lines, problem.key)
+		}
+		location := configFilePath
+		if source, ok := configOverrideSources[problem.key]; ok {
+			location = source
+		} else if line > 0 {
+			location += ":" + strconv.Itoa(line)
+		}
+		if problem.key != "" {
+			location += ": " + problem.key
+		}
+		if problem.warning {
+			logWarn("Warning: %s: %s", location, problem.message)
+		} else {
+			logError("  %s: %s", location, problem.message)
+		}
+	}
+	if errorCount == 0 {
+		return EXIT_SUCCESS
+	}
+	return EXIT_CONFIG
+}
+
+// Count the config problems that are not warnings
+func countConfigErrors(problems []configProblem) (count int) {
+	for _, problem := range problems {
+		if !problem.warning {
+			count++
+		}
+	}
+	return
+}
+
+// Parse a yaml.v2 type error message such as "line 3: field foo not found
+// in type main.ConfigRSS" into a configProblem
+func parseYAMLProblem(msg string) configProblem {
+	problem := configProblem{message: msg}
+	if strings.HasPrefix(msg, "line ") {
+		if i := strings.Index(msg, ": "); i > 0 {
+			if line, err := strconv.Atoi(msg[len("line "):i]); err == nil {
+				problem.line = line
+				problem.message = msg[i+2:]
+			}
+		}
+	}
+	return problem
+}
+
+// Find the line number of the dotted YAML key in the config file lines.
+// Returns the line of the closest parent key if key is missing, or 0
+func configKeyLine(lines []string, key string) int {
+	parts := strings.Split(key, ".")
+	found, depth := 0, 0
+	parentIndent, childIndent := -1, 0
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		if indent <= parentIndent {
+			// Left the mapping of the parent key
+			break
+		}
+		if childIndent < 0 {
+			childIndent = indent
+		}
+		if indent != childIndent || !strings.HasPrefix(trimmed, parts[depth]+":") {
+			continue
+		}
+		found = i + 1
+		depth++
+		if depth == len(parts) {
+			break
+		}
+		parentIndent, childIndent = indent, -1
+	}
+	return found
+}
+
+// Validate config and return every problem found
+func validateConfig(config Config) (problems []configProblem) {
+	problem := func(key, format string, a ...interface{}) {
+		problems = append(problems,
+			configProblem{key: key, message: fmt.Sprintf(format, a...)})
+	}
+	warning := func(key, format string, a ...interface{}) {
+		problems = append(problems, configProblem{key: key,
+			message: fmt.Sprintf(format, a...), warning: true})
+	}
+	listeners := []configListener{}
+	addListener := func(key, location string) {
+		listener, err := parseConfigListener(key, location)
+		if err != nil {
+			problem(key, "%s", err)
+			return
+		}
+		for _, other := range listeners {
+			if listenersClash(listener, other) {
+				problem(key, "%q clashes with %s", location, other.key)
+			}
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if config.ShutdownTimeoutSeconds < 0 {
+		problem("shutdown_timeout_seconds", "%d must not be negative",
+			config.ShutdownTimeoutSeconds)
+	}
+
+	// Gemini
+	addListener("gemini.listening_location", config.Gemini.ListeningLocation)
+	if config.Gemini.SealedContentPath != "" {
+		if !fileExists(config.Gemini.SealedContentPath) {
+			problem("gemini.sealed_content_path",
+				"sealed content file %s does not exist",
+				config.Gemini.SealedContentPath)
+		}
+	} else {
+		checkDirectory(problem, "gemini.data_path", config.Gemini.DataPath)
+	}
+	for _, domain := range config.Gemini.DomainNames {
+		if strings.ContainsAny(domain, ":/ ") {
+			problem("gemini.domain_names",
+				"%q must be a domain name without scheme, port or path", domain)
+		}
+	}
+	tlsConfig := config.Gemini.TLS
+	if tlsConfig.KeyPath == "" {
+		problem("gemini.tls.key_path", "TLS key path is required")
+	}
+	if tlsConfig.CertPath == "" {
+		problem("gemini.tls.cert_path", "TLS certificate path is required")
+	}
+	if tlsConfig.KeyType != "" && !stringInSlice(tlsConfig.KeyType, tlsKeyTypes) {
+		problem("gemini.tls.key_type", "%q must be one of %s",
+			tlsConfig.KeyType, strings.Join(tlsKeyTypes, ", "))
+	}
+	if tlsConfig.ValidityDays < 0 {
+		problem("gemini.tls.validity_days", "%d must not be negative",
+			tlsConfig.ValidityDays)
+	}
+
+	// RSS
+	if config.RSS.Enabled {
+		source := config.RSS.FeedSourceGeminiPath
+		if source == "" {
+			problem("rss.feed_source_gemini_path",
+				"feed source is required when RSS is enabled")
+		} else if config.Gemini.SealedContentPath == "" &&
+			config.Gemini.DataPath != "" {
+			// Sealed content can only be checked after decrypting it.  The
+			// feed is empty until the feed source page is written
+			content := os.DirFS(config.Gemini.DataPath)
+			found := false
+			for _, extension := range []string{".gmi", ".gemini"} {
+				info, err := fs.Stat(content, contentName(source+extension))
+				found = found || (err == nil && !info.IsDir())
+			}
+			if !found {
+				warning("rss.feed_source_gemini_path", "no %s.gmi or "+
+					"%s.gemini page in the Gemini data path %s, the feed is "+
+					"empty", source, source, config.Gemini.DataPath)
+			}
+		}
+	}
+
+	// Files
+	if config.Files.Symlinks != "" &&
+		!stringInSlice(config.Files.Symlinks, symlinkPolicies) {
+		problem("files.symlinks", "%q must be one of %s",
+			config.Files.Symlinks, strings.Join(symlinkPolicies, ", "))
+	}
+	checkPatterns := func(key string, patterns []string) {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil ||
+				strings.Contains(pattern, "/") {
+				problem(key, "%q must be a file name pattern", pattern)
+			}
+		}
+	}
+	checkPatterns("files.deny_patterns", config.Files.DenyPatterns)
+	checkPatterns("files.allow_patterns", config.Files.AllowPatterns)
+
+	// Robots
+	for _, rule := range config.Robots.Rules {
+		if len(rule.UserAgents) == 0 {
+			problem("robots.rules", "every rule needs user_agents")
+		}
+		for _, protocol := range rule.Protocols {
+			if !stringInSlice(protocol, robotsProtocols) {
+				problem("robots.rules", "protocol %q must be one of %s",
+					protocol, strings.Join(robotsProtocols, ", "))
+			}
+		}
+		for _, rulePath := range append(append([]string{}, rule.Allow...),
+			rule.Disallow...) {
+			if !strings.HasPrefix(rulePath, "/") {
+				problem("robots.rules", "%q must be a URL path starting "+
+					"with /", rulePath)
+			}
+		}
+		for _, agent := range rule.UserAgents {
+			if stringInSlice(strings.ToLower(agent), geminiVirtualAgents) &&
+				!robotsRuleApplies(rule, ROBOTS_PROTOCOL_GEMINI) {
+				warning("robots.rules", "%s is a Gemini virtual agent, but "+
+					"the rule is not in the Gemini robots.txt", agent)
+			}
+		}
+	}
+
+	// HTTP
+	if config.HTTP.Enabled {
+		addListener("http.listening_location", config.HTTP.ListeningLocation)
+		checkDirectory(problem, "http.data_path", config.HTTP.DataPath)
+		if config.HTTP.LayoutHTMLPath == "" {
+			problem("http.layout_html_path", "HTML layout path is required")
+		} else if !fileExists(config.HTTP.LayoutHTMLPath) {
+			problem("http.layout_html_path", "HTML layout %s does not exist",
+				config.HTTP.LayoutHTMLPath)
+		} else if _, err := parseHTMLLayout(config); err != nil {
+			problem("http.layout_html_path", "HTML layout %s: %s",
+				config.HTTP.LayoutHTMLPath, err)
+		}
+		if baseURL := config.HTTP.BaseURL; baseURL != "" &&
+			!strings.HasPrefix(baseURL, "http://") &&
+			!strings.HasPrefix(baseURL, "https://") {
+			problem("http.base_url", "%q must be an http:// or https:// URL",
+				baseURL)
+		}
+		if prefix := config.HTTP.Links.GeminiProxyPrefix; prefix != "" &&
+			!strings.HasPrefix(prefix, "http://") &&
+			!strings.HasPrefix(prefix, "https://") {
+			problem("http.links.gemini_proxy_prefix", "%q must be an http:// "+
+				"or https:// URL", prefix)
+		}
+		for name, value := range config.HTTP.SecurityHeaders {
+			if !isHeaderName(name) {
+				problem("http.security_headers", "%q is not a valid header "+
+					"name", name)
+			} else if strings.ContainsAny(value, "\r\n") {
+				problem("http.security_headers", "%s must not contain line "+
+					"breaks", name)
+			}
+		}
+		https := config.HTTP.HTTPS
+		if https.Enabled {
+			addListener("http.https.listening_location", https.ListeningLocation)
+			if https.ACME.Challenge != "" &&
+				https.ACME.Challenge != ACME_CHALLENGE_TLS_ALPN_01 &&
+				https.ACME.Challenge != ACME_CHALLENGE_HTTP_01 {
+				problem("http.https.acme.challenge", "%q must be %s or %s",
+					https.ACME.Challenge, ACME_CHALLENGE_TLS_ALPN_01,
+					ACME_CHALLENGE_HTTP_01)
+			}
+			if !https.ACME.AcceptTermsOfService {
+				problem("http.https.acme.accept_terms_of_service",
+					"the ACME CA terms of service must be accepted to "+
+						"request certificates")
+			}
+			if https.ACME.CachePath == "" {
+				problem("http.https.acme.cache_path",
+					"ACME certificate cache path is required")
+			}
+			if https.ACME.DirectoryCAPath != "" &&
+				!fileExists(https.ACME.DirectoryCAPath) {
+				problem("http.https.acme.directory_ca_path",
+					"CA certificate %s does not exist",
+					https.ACME.DirectoryCAPath)
+			}
+			if len(https.ACME.DomainNames) == 0 &&
+				!hasPublicDomain(config.Gemini.DomainNames) {
+				problem("http.https.acme.domain_names",
+					"no domain names to request ACME certificates for")
+			}
+		}
+	}
+
+	// Tor
+	if config.Tor.Enabled {
+		if _, err := exec.LookPath("tor"); err != nil {
+			problem("tor.enabled", "tor is enabled but the tor binary was "+
+				"not found in PATH")
+		}
+		if config.Tor.TorrcPath == "" {
+			problem("tor.torrc_path", "torrc path is required")
+		}
+		if config.Tor.HiddenServicePrivateKeyPath == "" {
+			problem("tor.hidden_service_private_key_path",
+				"hidden service private key path is required")
+		}
+		checkTorPort(problem, "gemini.tor.virtual_port",
+			config.Gemini.Tor.VirtualPort)
+		if config.HTTP.Enabled {
+			checkTorPort(problem, "http.tor.virtual_port",
+				config.HTTP.Tor.VirtualPort)
+			if config.HTTP.Tor.VirtualPort == config.Gemini.Tor.VirtualPort {
+				problem("http.tor.virtual_port", "%d clashes with "+
+					"gemini.tor.virtual_port", config.HTTP.Tor.VirtualPort)
+			}
+		}
+		if config.Tor.UseBridges {
+			if len(config.Tor.Bridges) == 0 {
+				problem("tor.bridges", "at least one bridge line is "+
+					"required when use_bridges is enabled")
+			}
+			for _, bridge := range config.Tor.Bridges {
+				transport := bridgeLineTransport(bridge)
+				if transport != "" && !hasTorTransport(config, transport) {
+					problem("tor.pluggable_transports", "no pluggable "+
+						"transport for the %s bridge %q", transport, bridge)
+				}
+			}
+		}
+		for _, transport := range config.Tor.PluggableTransports {
+			if err := torTransportCommandError(transport); err != nil {
+				problem("tor.pluggable_transports", "pluggable transport "+
+					"command %s", err)
+				continue
+			}
+			if _, err := exec.LookPath(transport.Path); err != nil {
+				problem("tor.pluggable_transports", "pluggable transport "+
+					"binary %s was not found", transport.Path)
+			}
+		}
+	}
+
+	// Encryption
+	if config.Encryption.Enabled && config.Encryption.PassphraseFilePath != "" &&
+		!fileExists(config.Encryption.PassphraseFilePath) {
+		problem("encryption.passphrase_file_path",
+			"passphrase file %s does not exist",
+			config.Encryption.PassphraseFilePath)
+	}
+	return
+}
+
+// Parse a listening location into a configListener
+func parseConfigListener(key, location string) (configListener, error) {
+	listener := configListener{key: key}
+	if location == "" {
+		return listener, fmt.Errorf("listening location is required")
+	}
+	listener.network, listener.host = parseLocation(location)
+	switch listener.network {
+	case "unix":
+		if listener.host == "" {
+			return listener, fmt.Errorf("%q is missing the unix socket path",
+				location)
+		}
+		if dir := filepath.Dir(listener.host); !fileExists(dir) {
+			return listener, fmt.Errorf("directory %s for the unix socket "+
+				"does not exist", dir)
+		}
+		return listener, nil
+	case "udp":
+		return listener, fmt.Errorf("%q must be a tcp or unix location, "+
+			"udp is not supported", location)
+	}
+	host, port, err := net.SplitHostPort(listener.host)
+	if err != nil {
+		return listener, fmt.Errorf("%q must be host:port: %s", location, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return listener, fmt.Errorf("%q has an invalid port %s", location, port)
+	}
+	listener.host, listener.port = host, port
+	return listener, nil
+}
+
+// Check if two listening locations can not be listened on at the same time
+func listenersClash(a, b configListener) bool {
+	if a.network != b.network {
+		return false
+	}
+	if a.network == "unix" {
+		return a.host == b.host
+	}
+	if a.port != b.port || a.port == "0" {
+		return false
+	}
+	normalize := func(host string) string {
+		switch host {
+		case "", "0.0.0.0", "::":
+			return ""
+		case "localhost":
+			return "127.0.0.1"
+		}
+		return host
+	}
+	aHost, bHost := normalize(a.host), normalize(b.host)
+	return aHost == "" || bHost == "" || aHost == bHost
+}
+
+// Add a problem if path is not an existing directory
+func checkDirectory(problem func(string, string, ...interface{}), key,
+	path string) {
+	if path == "" {
+		problem(key, "data path is required")
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		problem(key, "directory %s does not exist", path)
+	} else if !info.IsDir() {
+		problem(key, "%s is not a directory", path)
+	}
+}
+
+// Add a problem if port is not a valid tor virtual port
+func checkTorPort(problem func(string, string, ...interface{}), key string,
+	port int) {
+	if port < 1 || port > 65535 {
+		problem(key, "%d must be a port between 1 and 65535", port)
+	}
+}
+
+// Check if any domain could get an ACME certificate
+func hasPublicDomain(domains []string) bool {
+	for _, domain := range domains {
+		if isPublicDomain(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a pluggable transport binary is configured for transport
+func hasTorTransport(config Config, transport string) bool {
+	for _, pt := range config.Tor.PluggableTransports {
+		if stringInSlice(transport, pt.Transports) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	EXIT_SUCCESS = 0
+	EXIT_FAILURE = 1
+	EXIT_USAGE   = 2
+	EXIT_CONFIG  = 3
+)
+
+var (
+	bergelmirCmd = os.Args[0]
+	globalFlags  cliGlobalFlags
+	cliCommands  []cliCommand
+)
+
+type cliGlobalFlags struct {
+	configPath string
+	workDir    string
+	logLevel   string
+	quiet      bool
+	// --set key=value config overrides, in order
+	set []string
+}
+
+type cliCommand struct {
+	name        string
+	usage       string
+	description string
+	// needsConfig is true if the config file is parsed before run
+	needsConfig bool
+	// setFlags adds the command flags to the command flag set
+	setFlags func(fs *flag.FlagSet)
+	run      func(args []string) int
+}
+
+func init() {
+	var feedBaseURL, buildOutputPath, buildBaseURL string
+	cliCommands = []cliCommand{
+		{
+			name:        "serve",
+			description: "Start the Gemini capsule, HTTP server and Tor (default command)",
+			needsConfig: true,
+			run: func(args []string) int {
+				return serve()
+			},
+		},
+		{
+			name:        "init",
+			description: "Create a new config file and project directories (prompts can be answered with flags)",
+			setFlags:    addInitFlags,
+			run: func(args []string) int {
+				return runInit()
+			},
+		},
+		{
+			name:        "check",
+			description: "Check the config file",
+			run: func(args []string) int {
+				return checkConfig()
+			},
+		},
+		{
+			name:        "version",
+			description: "Show the bergelmir version",
+			run: func(args []string) int {
+				fmt.Printf("bergelmir %s\n", VERSION)
+				return EXIT_SUCCESS
+			},
+		},
+		{
+			name:        "help",
+			usage:       "[command]",
+			description: "Show help for bergelmir or a command",
+			run: func(args []string) int {
+				if len(args) > 0 {
+					if command := findCLICommand(args[0]); command != nil {
+						newCommandFlagSet(command, os.Stdout).Usage()
+						return EXIT_SUCCESS
+					}
+					fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+					printCLIUsage(os.Stderr)
+					return EXIT_USAGE
+				}
+				printCLIUsage(os.Stdout)
+				return EXIT_SUCCESS
+			},
+		},
+		{
+			name:        "cert",
+			usage:       "<info|regenerate>",
+			description: "Show or regenerate the Gemini capsule TLS certificate",
+			needsConfig: true,
+			run: func(args []string) int {
+				return runCertCommand(subcommandArg(args))
+			},
+		},
+		{
+			name:        "onion",
+			usage:       "address",
+			description: "Show the onion address of the tor hidden service private key",
+			needsConfig: true,
+			run: func(args []string) int {
+				return runOnionCommand(subcommandArg(args))
+			},
+		},
+		{
+			name:        "feed",
+			description: "Print the RSS feed of the feed source Gemini page",
+			needsConfig: true,
+			setFlags: func(fs *flag.FlagSet) {
+				fs.StringVar(&feedBaseURL, "base-url", "",
+					"URL the feed links are relative to (default gemini://<first domain name>)")
+			},
+			run: func(args []string) int {
+				return printFeed(feedBaseURL)
+			},
+		},
+		{
+			name:        "build",
+			description: "Render the Gemini capsule to static HTML files",
+			needsConfig: true,
+			setFlags: func(fs *flag.FlagSet) {
+				fs.StringVar(&buildOutputPath, "output", "public",
+					"directory to write the static HTML files to")
+				fs.StringVar(&buildBaseURL, "base-url", "",
+					"URL the feed links are relative to (default http.base_url or https://<first public domain name>)")
+			},
+			run: func(args []string) int {
+				if buildBaseURL == "" {
+					buildBaseURL = defaultBuildBaseURL()
+				}
+				if buildBaseURL == "" {
+					logError("--base-url is required when neither " +
+						"http.base_url nor a public Gemini domain name is " +
+						"configured")
+					return EXIT_USAGE
+				}
+				return buildStaticSite(buildOutputPath, buildBaseURL)
+			},
+		},
+		{
+			name:        "keys",
+			usage:       "<encrypt|decrypt>",
+			description: "Encrypt or decrypt the TLS and tor hidden service private keys",
+			needsConfig: true,
+			run: func(args []string) int {
+				return runKeysCommand(subcommandArg(args))
+			},
+		},
+		{
+			name:        "content",
+			usage:       "<seal> [path]",
+			description: "Seal the Gemini capsule content into an encrypted bundle",
+			needsConfig: true,
+			run: func(args []string) int {
+				return runContentCommand(subcommandArg(args), restArgs(args))
+			},
+		},
+		{
+			name:        "config",
+			usage:       "<migrate|show>",
+			description: "Upgrade the config file or show the effective config",
+			needsConfig: true,
+			setFlags: func(fs *flag.FlagSet) {
+				fs.BoolVar(&configMigrateDryRun, "dry-run", false,
+					"show the changes without writing the config file")
+			},
+			run: func(args []string) int {
+				return runConfigCommand(subcommandArg(args), restArgs(args))
+			},
+		},
+		{
+			name:        "identity",
+			usage:       "<export|import> <path>",
+			description: "Back up or restore the onion and TLS identity",
+			run: func(args []string) int {
+				subcommand := subcommandArg(args)
+				// identity import can restore a missing config file
+				if subcommand != "import" || fileExists(configFilePath) {
+					if code := loadConfigForCLI(); code != EXIT_SUCCESS {
+						return code
+					}
+				}
+				return runIdentityCommand(subcommand, restArgs(args))
+			},
+		},
+	}
+}
+
+// Add the global flags to fs
+func addGlobalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&globalFlags.configPath, "config", globalFlags.configPath,
+		"path of the config file, relative to the working directory")
+	fs.StringVar(&globalFlags.workDir, "workdir", globalFlags.workDir,
+		"directory to change to before doing anything else")
+	fs.StringVar(&globalFlags.logLevel, "log-level", globalFlags.logLevel,
+		"log level (debug, info, warn or error)")
+	fs.BoolVar(&globalFlags.quiet, "quiet", globalFlags.quiet,
+		"only log errors (same as --log-level error)")
+	fs.Func("set", "override a config field, such as --set "+
+		"http.listening_location=0.0.0.0:8080 (repeatable, takes "+
+		"precedence over "+CONFIG_ENV_PREFIX+"* environment variables)",
+		func(value string) error {
+			if !strings.Contains(value, "=") {
+				return fmt.Errorf("%q must be key=value", value)
+			}
+			globalFlags.set = append(globalFlags.set, value)
+			return nil
+		})
+}
+
+// Get the subcommand of args, or help if there is none
+func subcommandArg(args []string) string {
+	if len(args) == 0 {
+		return "help"
+	}
+	return strings.ToLower(args[0])
+}
+
+// Get args after the subcommand
+func restArgs(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	return args[1:]
+}
+
+// Find CLI command by name
+func findCLICommand(name string) *cliCommand {
+	for i := range cliCommands {
+		if cliCommands[i].name == name {
+			return &cliCommands[i]
+		}
+	}
+	return nil
+}
+
+// Print bergelmir usage with all commands and global flags to w
+func printCLIUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [global flags] <command> [flags] [arguments]\n\n",
+		bergelmirCmd)
+	fmt.Fprintln(w, "Commands:")
+	for _, command := range cliCommands {
+		fmt.Fprintf(w, "  %-9s %s\n", command.name, command.description)
+	}
+	fmt.Fprintln(w, "\nGlobal flags:")
+	fs := flag.NewFlagSet(bergelmirCmd, flag.ContinueOnError)
+	fs.SetOutput(w)
+	addGlobalFlags(fs)
+	fs.PrintDefaults()
+	fmt.Fprintf(w, "\nUse `%s help <command>` for more about a command.\n",
+		bergelmirCmd)
+}
+
+// Create flag set of command with the global flags and the command flags
+func newCommandFlagSet(command *cliCommand, w io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(command.name, flag.ContinueOnError)
+	fs.SetOutput(w)
+	addGlobalFlags(fs)
+	if command.setFlags != nil {
+		command.setFlags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s\n\n%s\n\nFlags:\n",
+			strings.TrimSpace(bergelmirCmd+" "+command.name+" [flags] "+
+				command.usage), command.description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Parse the config file, returning the config exit code instead of exiting
+// if it can't be parsed
+func loadConfigForCLI() int {
+	if !fileExists(configFilePath) {
+		logError("Unable to find config file %s", configFilePath)
+		logError("Use `%s init` to create one or --config to use another "+
+			"config file.", bergelmirCmd)
+		return EXIT_CONFIG
+	}
+	config, err := readConfigFile(configFilePath)
+	if err != nil {
+		logError("Unable to parse config file %s: %s", configFilePath, err)
+		return EXIT_CONFIG
+	}
+	configData = config
+	return EXIT_SUCCESS
+}
+
+// Apply the global flags that were parsed
+func applyGlobalFlags() int {
+	if globalFlags.workDir != "" {
+		if err := os.Chdir(globalFlags.workDir); err != nil {
+			logError("Unable to change to working directory %s: %s",
+				globalFlags.workDir, err)
+			return EXIT_FAILURE
+		}
+	}
+	configFilePath = globalFlags.configPath
+	configSetOverrides = globalFlags.set
+	if globalFlags.quiet {
+		globalFlags.logLevel = "error"
+	}
+	if err := setLogLevel(globalFlags.logLevel); err != nil {
+		logError("%s", err)
+		return EXIT_USAGE
+	}
+	return EXIT_SUCCESS
+}
+
+// Run bergelmir with command line arguments args and return the exit code
+func runCLI(args []string) int {
+	globalFlags = cliGlobalFlags{
+		configPath: DEFAULT_CONFIG_FILE_PATH,
+		logLevel:   "info",
+	}
+	// Global flags may come before the command
+	rootFlagSet := flag.NewFlagSet(bergelmirCmd, flag.ContinueOnError)
+	rootFlagSet.SetOutput(io.Discard)
+	addGlobalFlags(rootFlagSet)
+	if err := rootFlagSet.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			printCLIUsage(os.Stdout)
+			return EXIT_SUCCESS
+		}
+		fmt.Fprintf(os.Stderr, "%s\n\n", err)
+		printCLIUsage(os.Stderr)
+		return EXIT_USAGE
+	}
+	args = rootFlagSet.Args()
+	commandName := "serve"
+	if len(args) > 0 {
+		commandName = strings.ToLower(args[0])
+		args = args[1:]
+	}
+	command := findCLICommand(commandName)
+	if command == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", commandName)
+		printCLIUsage(os.Stderr)
+		return EXIT_USAGE
+	}
+	// Global flags may also come after the command
+	fs := newCommandFlagSet(command, os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_SUCCESS
+		}
+		return EXIT_USAGE
+	}
+	if code := applyGlobalFlags(); code != EXIT_SUCCESS {
+		return code
+	}
+	if command.needsConfig {
+		if code := loadConfigForCLI(); code != EXIT_SUCCESS {
+			return code
+		}
+	}
+	return command.run(fs.Args())
+}
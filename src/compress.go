@@ -0,0 +1,261 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	ENCODING_BROTLI = "br"
+	ENCODING_GZIP   = "gzip"
+	// Default smallest response size in bytes that is compressed
+	COMPRESSION_DEFAULT_MIN_SIZE = 1024
+)
+
+var (
+	// Content encodings in order of preference, with the file extension of
+	// precompressed files
+	contentEncodings = []struct {
+		name      string
+		extension string
+	}{
+		{ENCODING_BROTLI, ".br"},
+		{ENCODING_GZIP, ".gz"},
+	}
+	// Default content types that are compressed on the fly
+	defaultCompressedContentTypes = []string{
+		"text/*",
+		"application/atom+xml",
+		"application/javascript",
+		"application/json",
+		"application/rss+xml",
+		"application/xml",
+		"image/svg+xml",
+	}
+)
+
+// A response writer that compresses 200 OK response bodies
+type compressResponseWriter struct {
+	http.ResponseWriter
+	request  *http.Request
+	encoding string
+	encoder  io.WriteCloser
+	// wroteHeader is true once the status code was written
+	wroteHeader bool
+}
+
+func (c *compressResponseWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	if status == http.StatusOK {
+		header := c.Header()
+		// The compressed length is only known after compressing
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", c.encoding)
+		if c.request.Method != http.MethodHead {
+			c.encoder = newContentEncoder(c.encoding, c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressResponseWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.encoder != nil {
+		return c.encoder.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush the end of the compressed body
+func (c *compressResponseWriter) Close() error {
+	if c.encoder != nil {
+		return c.encoder.Close()
+	}
+	return nil
+}
+
+// Create a compressing writer for a content encoding
+func newContentEncoder(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == ENCODING_BROTLI {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}
+	return gzip.NewWriter(w)
+}
+
+// Get the q values of the content encodings the client accepts from the
+// Accept-Encoding request header
+func acceptedEncodings(r *http.Request) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
+
+// Get the preferred content encoding the client accepts, for which
+// available returns true.  Returns "" for no encoding
+func negotiateEncoding(r *http.Request, available func(encoding,
+	extension string) bool) string {
+	accepted := acceptedEncodings(r)
+	best, bestQ := "", 0.0
+	for _, encoding := range contentEncodings {
+		q, ok := accepted[encoding.name]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ && available(encoding.name, encoding.extension) {
+			best, bestQ = encoding.name, q
+		}
+	}
+	return best
+}
+
+// Check if responses of contentType are compressed on the fly
+func isCompressibleContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	contentTypes := getConfig().HTTP.Compression.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = defaultCompressedContentTypes
+	}
+	for _, t := range contentTypes {
+		if t == mediaType || (strings.HasSuffix(t, "/*") &&
+			strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the ETag of the content encoding variant of a response.  The
+// variants need different ETags as their bytes differ
+func encodedETag(etag, encoding string) string {
+	if etag == "" || encoding == "" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""
+}
+
+// Remove the content encoding suffix of an ETag
+func decodedETag(etag string) string {
+	for _, encoding := range contentEncodings {
+		suffix := "-" + encoding.name + "\""
+		if strings.HasSuffix(etag, suffix) {
+			return strings.TrimSuffix(etag, suffix) + "\""
+		}
+	}
+	return etag
+}
+
+// Get the content encoding a response of contentType and size bytes is
+// compressed with on the fly, or "" if it is sent uncompressed.  Range
+// requests are served uncompressed.  Adds Accept-Encoding to the Vary
+// response header if the encoding depends on it
+func responseEncoding(w http.ResponseWriter, r *http.Request,
+	contentType string, size int64) string {
+	compression := getConfig().HTTP.Compression
+	if !compression.Enabled || !isCompressibleContentType(contentType) {
+		return ""
+	}
+	addVaryAcceptEncoding(w)
+	minSize := int64(compression.MinSizeBytes)
+	if minSize <= 0 {
+		minSize = COMPRESSION_DEFAULT_MIN_SIZE
+	}
+	if size < minSize || r.Header.Get("Range") != "" {
+		return ""
+	}
+	return negotiateEncoding(r, func(string, string) bool {
+		return true
+	})
+}
+
+// Serve a response of contentType and size bytes with serve, compressing
+// it on the fly if compression is enabled and the client accepts it.  The
+// ETag response header is set to the ETag of the variant that is sent
+func serveCompressed(w http.ResponseWriter, r *http.Request,
+	contentType string, size int64, serve func(w http.ResponseWriter)) {
+	encoding := responseEncoding(w, r, contentType, size)
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", encodedETag(decodedETag(etag), encoding))
+	}
+	if encoding == "" {
+		serve(w)
+		return
+	}
+	cw := &compressResponseWriter{ResponseWriter: w, request: r,
+		encoding: encoding}
+	defer cw.Close()
+	serve(cw)
+}
+
+// Open the precompressed sibling (<name>.br or <name>.gz) of the file name
+// in root that the client prefers.  Returns a nil file if there is none
+func openPrecompressedFile(r *http.Request, root fs.FS, name string) (
+	f fs.File, encoding string) {
+	if !getConfig().HTTP.Compression.Enabled {
+		return
+	}
+	encoding = negotiateEncoding(r, func(_, extension string) bool {
+		info, err := fs.Stat(root, name+extension)
+		return err == nil && info.Mode().IsRegular()
+	})
+	for _, e := range contentEncodings {
+		if e.name == encoding {
+			f, err := root.Open(name + e.extension)
+			if err != nil {
+				return nil, ""
+			}
+			return f, encoding
+		}
+	}
+	return nil, ""
+}
+
+// Add Accept-Encoding to the Vary response header once
+func addVaryAcceptEncoding(w http.ResponseWriter) {
+	for _, vary := range w.Header().Values("Vary") {
+		if strings.EqualFold(vary, "Accept-Encoding") {
+			return
+		}
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+}
+
+// Check if the file name in root has precompressed siblings
+func hasPrecompressedFile(root fs.FS, name string) bool {
+	for _, e := range contentEncodings {
+		if _, err := fs.Stat(root, name+e.extension); err == nil {
+			return true
+		}
+	}
+	return false
+}
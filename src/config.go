@@ -1,26 +1,78 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v2"
 )
 
 const (
-	CONFIG_FILE_PATH = "config.yaml"
+	DEFAULT_CONFIG_FILE_PATH = "config.yaml"
+	CONFIG_ENV_PREFIX        = "BERGELMIR_"
+	CONFIG_REDACTED          = "<redacted>"
 )
 
 var (
-	configData Config
+	configData     Config
+	configFilePath = DEFAULT_CONFIG_FILE_PATH
+	// --set key=value config overrides, in order
+	configSetOverrides []string
+	// Where the overridden config fields got their value from, by dotted
+	// YAML key
+	configOverrideSources = map[string]string{}
+	// configLock guards configData while serving, as the config can be
+	// reloaded on SIGHUP
+	configLock sync.RWMutex
 )
 
+// A config field found by walking Config.  key is the dotted YAML key of the
+// field, such as http.listening_location
+type configField struct {
+	key    string
+	value  reflect.Value
+	secret bool
+}
+
 type Config struct {
-	BergelmirVersion string       `yaml:"bergelmir_version"`
-	RSS              ConfigRSS    `yaml:"rss"`
-	Tor              ConfigTor    `yaml:"tor"`
-	Gemini           ConfigGemini `yaml:"gemini"`
-	HTTP             ConfigHTTP   `yaml:"http"`
+	BergelmirVersion       string           `yaml:"bergelmir_version"`
+	ShutdownTimeoutSeconds int              `yaml:"shutdown_timeout_seconds"`
+	RSS                    ConfigRSS        `yaml:"rss"`
+	Tor                    ConfigTor        `yaml:"tor"`
+	Gemini                 ConfigGemini     `yaml:"gemini"`
+	HTTP                   ConfigHTTP       `yaml:"http"`
+	Files                  ConfigFiles      `yaml:"files"`
+	Robots                 ConfigRobots     `yaml:"robots"`
+	Encryption             ConfigEncryption `yaml:"encryption"`
+}
+
+type ConfigRobots struct {
+	Rules []ConfigRobotsRule `yaml:"rules"`
+}
+
+type ConfigRobotsRule struct {
+	UserAgents []string `yaml:"user_agents"`
+	Protocols  []string `yaml:"protocols"`
+	Allow      []string `yaml:"allow"`
+	Disallow   []string `yaml:"disallow"`
+}
+
+type ConfigFiles struct {
+	Symlinks      string   `yaml:"symlinks"`
+	DenyPatterns  []string `yaml:"deny_patterns"`
+	AllowPatterns []string `yaml:"allow_patterns"`
+}
+
+type ConfigEncryption struct {
+	Enabled            bool   `yaml:"enabled"`
+	PassphraseEnv      string `yaml:"passphrase_env"`
+	PassphraseFilePath string `yaml:"passphrase_file_path"`
 }
 
 type ConfigRSS struct {
@@ -29,24 +81,44 @@ type ConfigRSS struct {
 }
 
 type ConfigTor struct {
-	Enabled                     bool   `yaml:"enabled"`
-	ControlPortFilePath         string `yaml:"control_port_file_path"`
-	ControlAuthCookiePath       string `yaml:"control_auth_cookie_path"`
-	HiddenServicePrivateKeyPath string `yaml:"hidden_service_private_key_path"`
-	TorrcPath                   string `yaml:"torrc_path"`
+	Enabled                     bool                 `yaml:"enabled"`
+	ControlPortFilePath         string               `yaml:"control_port_file_path"`
+	ControlAuthCookiePath       string               `yaml:"control_auth_cookie_path"`
+	HiddenServicePrivateKeyPath string               `yaml:"hidden_service_private_key_path"`
+	TorrcPath                   string               `yaml:"torrc_path"`
+	UseBridges                  bool                 `yaml:"use_bridges"`
+	Bridges                     []string             `yaml:"bridges" secret:"true"`
+	PluggableTransports         []ConfigTorTransport `yaml:"pluggable_transports"`
+}
+
+type ConfigTorTransport struct {
+	Transports []string `yaml:"transports"`
+	Path       string   `yaml:"path"`
+	Args       []string `yaml:"args"`
 }
 
 type ConfigGemini struct {
-	DomainNames       []string        `yaml:"domain_names"`
-	DataPath          string          `yaml:"data_path"`
-	ListeningLocation string          `yaml:"listening_location"`
-	TLS               ConfigGeminiTLS `yaml:"tls"`
-	Tor               ConfigGeminiTor `yaml:"tor"`
+	DomainNames       []string               `yaml:"domain_names"`
+	DataPath          string                 `yaml:"data_path"`
+	SealedContentPath string                 `yaml:"sealed_content_path"`
+	ListeningLocation string                 `yaml:"listening_location"`
+	TLS               ConfigGeminiTLS        `yaml:"tls"`
+	Tor               ConfigGeminiTor        `yaml:"tor"`
+	Navigation        ConfigGeminiNavigation `yaml:"navigation"`
+}
+
+type ConfigGeminiNavigation struct {
+	Breadcrumbs     bool `yaml:"breadcrumbs"`
+	TableOfContents bool `yaml:"table_of_contents"`
+	PostLinks       bool `yaml:"post_links"`
 }
 
 type ConfigGeminiTLS struct {
-	KeyPath  string `yaml:"key_path"`
-	CertPath string `yaml:"cert_path"`
+	KeyPath      string `yaml:"key_path"`
+	CertPath     string `yaml:"cert_path"`
+	KeyType      string `yaml:"key_type"`
+	CommonName   string `yaml:"common_name"`
+	ValidityDays int    `yaml:"validity_days"`
 }
 
 type ConfigGeminiTor struct {
@@ -54,42 +126,280 @@ type ConfigGeminiTor struct {
 }
 
 type ConfigHTTP struct {
-	Enabled           bool          `yaml:"enabled"`
-	ListeningLocation string        `yaml:"listening_location"`
-	DataPath          string        `yaml:"data_path"`
-	LayoutHTMLPath    string        `yaml:"layout_html_path"`
-	DefaultPageTitle  string        `yaml:"default_page_title"`
-	Tor               ConfigHTTPTor `yaml:"tor"`
+	Enabled            bool                  `yaml:"enabled"`
+	ListeningLocation  string                `yaml:"listening_location"`
+	DataPath           string                `yaml:"data_path"`
+	LayoutHTMLPath     string                `yaml:"layout_html_path"`
+	LayoutPartialsPath string                `yaml:"layout_partials_path"`
+	BaseURL            string                `yaml:"base_url"`
+	SitemapEnabled     bool                  `yaml:"sitemap_enabled"`
+	DefaultPageTitle   string                `yaml:"default_page_title"`
+	CacheControl       map[string]string     `yaml:"cache_control"`
+	SecurityHeaders    map[string]string     `yaml:"security_headers"`
+	Compression        ConfigHTTPCompression `yaml:"compression"`
+	Links              ConfigHTTPLinks       `yaml:"links"`
+	Tor                ConfigHTTPTor         `yaml:"tor"`
+	HTTPS              ConfigHTTPHTTPS       `yaml:"https"`
+}
+
+type ConfigHTTPCompression struct {
+	Enabled      bool     `yaml:"enabled"`
+	MinSizeBytes int      `yaml:"min_size_bytes"`
+	ContentTypes []string `yaml:"content_types"`
+}
+
+type ConfigHTTPLinks struct {
+	RewriteCapsuleLinks bool   `yaml:"rewrite_capsule_links"`
+	RewriteOnionLinks   bool   `yaml:"rewrite_onion_links"`
+	GeminiProxyPrefix   string `yaml:"gemini_proxy_prefix"`
+}
+
+type ConfigHTTPHTTPS struct {
+	Enabled           bool                `yaml:"enabled"`
+	ListeningLocation string              `yaml:"listening_location"`
+	RedirectHTTP      bool                `yaml:"redirect_http"`
+	ACME              ConfigHTTPHTTPSACME `yaml:"acme"`
+}
+
+type ConfigHTTPHTTPSACME struct {
+	DirectoryURL         string   `yaml:"directory_url"`
+	DirectoryCAPath      string   `yaml:"directory_ca_path"`
+	Challenge            string   `yaml:"challenge"`
+	DomainNames          []string `yaml:"domain_names"`
+	Email                string   `yaml:"email"`
+	AcceptTermsOfService bool     `yaml:"accept_terms_of_service"`
+	CachePath            string   `yaml:"cache_path"`
 }
 
 type ConfigHTTPTor struct {
 	VirtualPort int `yaml:"virtual_port"`
 }
 
-// Open config file and parse contents into configData
-func parseConfigData() {
-	if !fileExists(CONFIG_FILE_PATH) {
-		fmt.Printf("Unable to find config file %s\n", CONFIG_FILE_PATH)
-		fmt.Printf("Use `%s init` to create one.\n", bergelmirCmd)
-		fmt.Println("Exiting...")
-		os.Exit(1)
-		// Create config file if file does not exist
-		generateConfigFile()
+// Open config file at path and parse contents into a Config, then apply
+// the environment variable and --set overrides
+func readConfigFile(path string) (config Config, err error) {
+	c, err := os.Open(path)
+	if err != nil {
 		return
 	}
-	c, err := os.Open(CONFIG_FILE_PATH)
-	handleErr(err, "Unable to open config file at "+CONFIG_FILE_PATH)
 	defer c.Close()
-	configData = Config{}
-	handleErr(yaml.NewDecoder(c).Decode(&configData),
-		"Unable to parse config file "+CONFIG_FILE_PATH)
+	if err = yaml.NewDecoder(c).Decode(&config); err != nil {
+		return
+	}
+	err = applyConfigOverrides(&config)
+	return
+}
+
+// Override config fields from the environment and then the --set flags, so
+// the precedence is config file < BERGELMIR_* environment variables < --set
+func applyConfigOverrides(config *Config) error {
+	configOverrideSources = map[string]string{}
+	fields := configFields(reflect.ValueOf(config).Elem(), "")
+	for _, field := range fields {
+		envName := configEnvName(field.key)
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setConfigField(field, value); err != nil {
+			return fmt.Errorf("%s: %s", envName, err)
+		}
+		configOverrideSources[field.key] = envName
+	}
+	for _, set := range configSetOverrides {
+		key, value, _ := strings.Cut(set, "=")
+		key = strings.TrimSpace(key)
+		field, ok := findConfigField(fields, key)
+		if !ok {
+			return fmt.Errorf("--set %s: unknown config field %q", set, key)
+		}
+		if err := setConfigField(field, value); err != nil {
+			return fmt.Errorf("--set %s: %s", set, err)
+		}
+		configOverrideSources[field.key] = "--set " + key
+	}
+	return nil
+}
+
+// Get every settable config field of the struct v.  Nested structs are
+// walked, so only their fields are returned
+func configFields(v reflect.Value, prefix string) (fields []configField) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		key := prefix + name
+		if v.Field(i).Kind() == reflect.Struct {
+			fields = append(fields, configFields(v.Field(i), key+".")...)
+			continue
+		}
+		fields = append(fields, configField{
+			key:    key,
+			value:  v.Field(i),
+			secret: t.Field(i).Tag.Get("secret") == "true",
+		})
+	}
+	return
+}
+
+// Find the config field with the dotted YAML key
+func findConfigField(fields []configField, key string) (configField, bool) {
+	for _, field := range fields {
+		if field.key == key {
+			return field, true
+		}
+	}
+	return configField{}, false
+}
+
+// Get the environment variable name of the dotted YAML key, such as
+// BERGELMIR_HTTP_LISTENING_LOCATION for http.listening_location
+func configEnvName(key string) string {
+	return CONFIG_ENV_PREFIX +
+		strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Set the config field from a string value.  Lists are comma separated or
+// YAML flow sequences, such as [a, b], and maps are YAML flow mappings, such
+// as {a: b}
+func setConfigField(field configField, value string) error {
+	switch field.value.Kind() {
+	case reflect.String:
+		field.value.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q must be true or false", value)
+		}
+		field.value.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q must be an integer", value)
+		}
+		field.value.SetInt(int64(i))
+	case reflect.Slice:
+		trimmed := strings.TrimSpace(value)
+		if field.value.Type().Elem().Kind() == reflect.String &&
+			!strings.HasPrefix(trimmed, "[") {
+			list := []string{}
+			for _, item := range strings.Split(trimmed, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.value.Set(reflect.ValueOf(list))
+			return nil
+		}
+		list := reflect.New(field.value.Type())
+		if err := yaml.Unmarshal([]byte(trimmed), list.Interface()); err != nil {
+			return fmt.Errorf("%q must be a YAML list: %s", value, err)
+		}
+		field.value.Set(list.Elem())
+	case reflect.Map:
+		m := reflect.New(field.value.Type())
+		if err := yaml.Unmarshal([]byte(value), m.Interface()); err != nil {
+			return fmt.Errorf("%q must be a YAML mapping, such as "+
+				"{a: b}: %s", value, err)
+		}
+		field.value.Set(m.Elem())
+	default:
+		return fmt.Errorf("unsupported config field type %s",
+			field.value.Type())
+	}
+	return nil
+}
+
+// Print the effective config with the overrides applied and secrets
+// redacted.  Returns the exit code
+func showConfig() int {
+	config := configData
+	for _, field := range configFields(reflect.ValueOf(&config).Elem(), "") {
+		if !field.secret || field.value.Len() == 0 {
+			continue
+		}
+		redacted := make([]string, field.value.Len())
+		for i := range redacted {
+			redacted[i] = CONFIG_REDACTED
+		}
+		field.value.Set(reflect.ValueOf(redacted))
+	}
+	content, err := yaml.Marshal(&config)
+	if err != nil {
+		logError("Unable to encode config: %s", err)
+		return EXIT_FAILURE
+	}
+	fmt.Printf("# Effective config of %s\n", configFilePath)
+	keys := make([]string, 0, len(configOverrideSources))
+	for key := range configOverrideSources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("# %s from %s\n", key, configOverrideSources[key])
+	}
+	fmt.Print(string(content))
+	return EXIT_SUCCESS
+}
+
+var configMigrateDryRun bool
+
+// Run `bergelmir config <subcommand>`.  Returns the exit code
+func runConfigCommand(subcommand string, args []string) int {
+	switch subcommand {
+	case "migrate":
+		// Flags may also come after the subcommand
+		fs := flag.NewFlagSet("config migrate", flag.ContinueOnError)
+		fs.BoolVar(&configMigrateDryRun, "dry-run", configMigrateDryRun,
+			"show the changes without writing the config file")
+		if err := fs.Parse(args); err != nil {
+			return EXIT_USAGE
+		}
+		if code := validateConfigFile(); code != EXIT_SUCCESS {
+			return code
+		}
+		code, migrated := migrateConfigFile(configMigrateDryRun)
+		if code == EXIT_SUCCESS && !migrated {
+			fmt.Printf("Config file %s is up to date (version %s)\n",
+				configFilePath, VERSION)
+		}
+		return code
+	case "show":
+		return showConfig()
+	default:
+		fmt.Printf("Usage: %s config <subcommand>\n\n", bergelmirCmd)
+		fmt.Println("Subcommands:")
+		fmt.Println("  migrate  Upgrade the config file to the current " +
+			"config schema (--dry-run to only show the changes)")
+		fmt.Println("  show     Show the effective config with the " +
+			CONFIG_ENV_PREFIX + "* environment variable and --set " +
+			"overrides applied, with secrets redacted")
+		if subcommand != "help" {
+			return EXIT_USAGE
+		}
+		return EXIT_SUCCESS
+	}
+}
+
+// Get a copy of configData that can be used by request handlers while the
+// config is reloaded
+func getConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return configData
+}
+
+// Replace configData with config
+func setConfig(config Config) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	configData = config
 }
 
 // Write configData to config file
 func generateConfigFile() {
-	c, err := os.Create(CONFIG_FILE_PATH)
+	c, err := os.Create(configFilePath)
 	defer c.Close()
-	handleErr(err, "Unable to create config file at "+CONFIG_FILE_PATH)
+	handleErr(err, "Unable to create config file at "+configFilePath)
 	handleErr(yaml.NewEncoder(c).Encode(&configData),
-		"Unable to write config file "+CONFIG_FILE_PATH)
+		"Unable to write config file "+configFilePath)
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	// Gemini capsule content, either the Gemini data path directory or the
+	// decrypted sealed content bundle
+	geminiContent     fs.FS
+	geminiContentLock sync.RWMutex
+)
+
+// Load Gemini capsule content from the sealed content bundle if configured,
+// otherwise from the Gemini data path directory
+func loadGeminiContent() {
+	content, err := openGeminiContent(configData)
+	handleErr(err, "Unable to open sealed Gemini content "+
+		configData.Gemini.SealedContentPath)
+	setGeminiContent(content)
+}
+
+// Open the Gemini capsule content of config, the Gemini data path or the
+// sealed content file.  Both hide the denied file names
+func openGeminiContent(config Config) (fs.FS, error) {
+	if config.Gemini.SealedContentPath == "" {
+		return dataRoot(config.Gemini.DataPath), nil
+	}
+	content, err := openSealedContent(config.Gemini.SealedContentPath)
+	if err != nil {
+		return nil, err
+	}
+	return filteredFS{content}, nil
+}
+
+// Replace the Gemini capsule content
+func setGeminiContent(content fs.FS) {
+	geminiContentLock.Lock()
+	defer geminiContentLock.Unlock()
+	geminiContent = content
+}
+
+// Get the Gemini capsule content
+func getGeminiContent() fs.FS {
+	geminiContentLock.RLock()
+	defer geminiContentLock.RUnlock()
+	return geminiContent
+}
+
+// Decrypt the sealed content bundle at sealedPath in memory
+func openSealedContent(sealedPath string) (fs.FS, error) {
+	sealed, err := os.ReadFile(sealedPath)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncryptedData(sealed) {
+		return nil, fmt.Errorf("%s is not a sealed content bundle", sealedPath)
+	}
+	archive, err := readFileDecrypted(sealedPath)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+}
+
+// Get the fs.FS name of a Gemini capsule URL path
+func contentName(urlPath string) string {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// Read Gemini capsule content file at URL path
+func readGeminiContentFile(urlPath string) ([]byte, error) {
+	return fs.ReadFile(getGeminiContent(), contentName(urlPath))
+}
+
+// Open Gemini capsule content file at URL path.  Directories are not
+// content files
+func openGeminiContentFile(urlPath string) (fs.File, error) {
+	f, err := getGeminiContent().Open(contentName(urlPath))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, fs.ErrNotExist
+	}
+	return f, nil
+}
+
+// Run `bergelmir content <subcommand>` and return the exit code
+func runContentCommand(subcommand string, args []string) int {
+	switch subcommand {
+	case "seal":
+		sealedPath := configData.Gemini.SealedContentPath
+		if len(args) > 0 {
+			sealedPath = args[0]
+		}
+		if sealedPath == "" {
+			fmt.Println("No sealed content path.  Set gemini.sealed_content_path " +
+				"in the config file or pass the output path")
+			return EXIT_USAGE
+		}
+		return sealGeminiContent(configData.Gemini.DataPath, sealedPath)
+	default:
+		fmt.Printf("Usage: %s content <subcommand>\n\n", bergelmirCmd)
+		fmt.Println("Subcommands:")
+		fmt.Println("  seal [path]  Encrypt the Gemini data path into a " +
+			"sealed content bundle")
+		if subcommand != "help" {
+			return EXIT_USAGE
+		}
+		return EXIT_SUCCESS
+	}
+}
+
+// Archive the files in dataPath and write them encrypted with the
+// encryption passphrase to sealedPath.  Returns the exit code
+func sealGeminiContent(dataPath, sealedPath string) int {
+	passphrase, err := getEncryptionPassphrase()
+	if err == nil && configData.Encryption.PassphraseFilePath == "" &&
+		os.Getenv(getPassphraseEnv()) == "" {
+		// Passphrase was typed, so make sure it was typed correctly
+		var confirmation []byte
+		confirmation, err = promptPassphrase("Repeat encryption passphrase: ")
+		if err == nil && string(confirmation) != string(passphrase) {
+			err = fmt.Errorf("passphrases do not match")
+		}
+	}
+	if err != nil {
+		fmt.Printf("Unable to get encryption passphrase: %s\n", err)
+		return EXIT_FAILURE
+	}
+	archive, fileCount, err := archiveDirectory(dataPath)
+	if err != nil {
+		fmt.Printf("Unable to archive %s: %s\n", dataPath, err)
+		return EXIT_FAILURE
+	}
+	sealed, err := encryptData(archive, passphrase)
+	if err == nil {
+		createFileDirectory(sealedPath)
+		err = writeFileAtomic(sealedPath, sealed)
+	}
+	if err != nil {
+		fmt.Printf("Unable to write sealed content %s: %s\n", sealedPath, err)
+		return EXIT_FAILURE
+	}
+	fmt.Printf("- Sealed %d files from %s into %s\n", fileCount, dataPath,
+		sealedPath)
+	if configData.Gemini.SealedContentPath != sealedPath {
+		fmt.Printf("Set gemini.sealed_content_path to %s in the config file "+
+			"to serve the sealed content\n", sealedPath)
+	}
+	return EXIT_SUCCESS
+}
+
+// Create a zip archive in memory of the regular files in dirPath
+func archiveDirectory(dirPath string) (archive []byte, fileCount int,
+	err error) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	err = filepath.WalkDir(dirPath, func(filePath string, d fs.DirEntry,
+		err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		relPath, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		header.Method = zip.Deflate
+		w, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		fileCount++
+		return err
+	})
+	if err == nil {
+		err = zipWriter.Close()
+	}
+	return buf.Bytes(), fileCount, err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/term"
+)
+
+const (
+	ENCRYPTED_PEM_TYPE       = "BERGELMIR ENCRYPTED DATA"
+	DEFAULT_PASSPHRASE_ENV   = "BERGELMIR_PASSPHRASE"
+	ARGON2ID_DEFAULT_TIME    = 3
+	ARGON2ID_DEFAULT_MEMORY  = 64 * 1024
+	ARGON2ID_DEFAULT_THREADS = 4
+	// Highest argon2id parameters accepted from encrypted files, so a
+	// crafted file can't make decryption take hours or all memory
+	ARGON2ID_MAX_TIME    = 16
+	ARGON2ID_MAX_MEMORY  = 1024 * 1024
+	ARGON2ID_MAX_THREADS = 16
+)
+
+var (
+	encryptionPassphrase     []byte
+	encryptionPassphraseLock sync.Mutex
+	errWrongPassphrase       = errors.New("wrong passphrase or corrupt data")
+)
+
+// Check if data was encrypted with encryptData
+func isEncryptedData(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == ENCRYPTED_PEM_TYPE
+}
+
+// Encrypt data with a key derived from passphrase using argon2id and
+// XChaCha20-Poly1305.  The argon2id parameters, salt and nonce are stored
+// as PEM headers so they can be changed without breaking old files
+func encryptData(data, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		"KDF":     "argon2id",
+		"Time":    strconv.Itoa(ARGON2ID_DEFAULT_TIME),
+		"Memory":  strconv.Itoa(ARGON2ID_DEFAULT_MEMORY),
+		"Threads": strconv.Itoa(ARGON2ID_DEFAULT_THREADS),
+		"Salt":    base64.StdEncoding.EncodeToString(salt),
+		"Cipher":  "xchacha20-poly1305",
+		"Nonce":   base64.StdEncoding.EncodeToString(nonce),
+	}
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt,
+		ARGON2ID_DEFAULT_TIME, ARGON2ID_DEFAULT_MEMORY,
+		ARGON2ID_DEFAULT_THREADS, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    ENCRYPTED_PEM_TYPE,
+		Headers: headers,
+		Bytes:   aead.Seal(nil, nonce, data, []byte(ENCRYPTED_PEM_TYPE)),
+	}), nil
+}
+
+// Decrypt data encrypted with encryptData
+func decryptData(data, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != ENCRYPTED_PEM_TYPE {
+		return nil, errors.New("data is not encrypted")
+	}
+	if block.Headers["KDF"] != "argon2id" ||
+		block.Headers["Cipher"] != "xchacha20-poly1305" {
+		return nil, fmt.Errorf("unsupported KDF %q or cipher %q",
+			block.Headers["KDF"], block.Headers["Cipher"])
+	}
+	var params [3]uint64
+	maxParams := [3]uint64{ARGON2ID_MAX_TIME, ARGON2ID_MAX_MEMORY,
+		ARGON2ID_MAX_THREADS}
+	for i, name := range []string{"Time", "Memory", "Threads"} {
+		var err error
+		params[i], err = strconv.ParseUint(block.Headers[name], 10, 32)
+		if err != nil || params[i] == 0 || params[i] > maxParams[i] {
+			return nil, fmt.Errorf("invalid argon2id %s", strings.ToLower(name))
+		}
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.New("invalid salt")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonce) != chacha20poly1305.NonceSizeX {
+		return nil, errors.New("invalid nonce")
+	}
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt,
+		uint32(params[0]), uint32(params[1]), uint8(params[2]),
+		chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, block.Bytes,
+		[]byte(ENCRYPTED_PEM_TYPE))
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+// Get the encryption passphrase from the passphrase environment variable,
+// the passphrase file or a terminal prompt, in that order.  The passphrase
+// is only looked up once
+func getEncryptionPassphrase() ([]byte, error) {
+	encryptionPassphraseLock.Lock()
+	defer encryptionPassphraseLock.Unlock()
+	if encryptionPassphrase != nil {
+		return encryptionPassphrase, nil
+	}
+	if passphrase := os.Getenv(getPassphraseEnv()); passphrase != "" {
+		encryptionPassphrase = []byte(passphrase)
+		return encryptionPassphrase, nil
+	}
+	if configData.Encryption.PassphraseFilePath != "" {
+		content, err := os.ReadFile(configData.Encryption.PassphraseFilePath)
+		if err != nil {
+			return nil, err
+		}
+		// Only the first line of the passphrase file is the passphrase
+		passphrase := strings.SplitN(string(content), "\n", 2)[0]
+		passphrase = strings.TrimSuffix(passphrase, "\r")
+		if passphrase == "" {
+			return nil, fmt.Errorf("passphrase file %s is empty",
+				configData.Encryption.PassphraseFilePath)
+		}
+		encryptionPassphrase = []byte(passphrase)
+		return encryptionPassphrase, nil
+	}
+	passphrase, err := promptPassphrase("Encryption passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	encryptionPassphrase = passphrase
+	return encryptionPassphrase, nil
+}
+
+// Get the name of the environment variable with the encryption passphrase
+func getPassphraseEnv() string {
+	if configData.Encryption.PassphraseEnv == "" {
+		return DEFAULT_PASSPHRASE_ENV
+	}
+	return configData.Encryption.PassphraseEnv
+}
+
+// Prompt for a passphrase on the terminal without echoing it
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no passphrase in $%s or passphrase file and "+
+			"stdin is not a terminal", getPassphraseEnv())
+	}
+	fmt.Print(prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// Read file at path and decrypt it if it is encrypted
+func readFileDecrypted(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil || !isEncryptedData(content) {
+		return content, err
+	}
+	passphrase, err := getEncryptionPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return decryptData(content, passphrase)
+}
+
+// Write private key content to path, encrypted if encryption at rest is
+// enabled
+func writePrivateKeyFile(path string, content []byte) error {
+	if configData.Encryption.Enabled {
+		passphrase, err := getEncryptionPassphrase()
+		if err != nil {
+			return err
+		}
+		content, err = encryptData(content, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, content, 0600)
+}
@@ -4,13 +4,13 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 	"unicode/utf8"
 )
@@ -38,7 +38,12 @@ const (
 )
 
 var (
-	geminiHostList = []string{}
+	geminiHostList     = []string{}
+	geminiHostListLock sync.RWMutex
+	// Open Gemini capsule connections
+	geminiConnections     = map[net.Conn]struct{}{}
+	geminiConnectionsLock sync.Mutex
+	geminiConnectionsDone sync.WaitGroup
 )
 
 // Write Gemini Response Header to client (3.1 of specification.gmi)
@@ -144,15 +149,14 @@ func handleGeminiResponseBody(conn net.Conn, urlPath, host string) {
 	if urlPath == "" {
 		urlPath = "/index"
 	}
-	geminiDataPath := configData.Gemini.DataPath + "/" + urlPath
 	if urlExtension == "" {
 		if !isRSSFeed(urlPath) {
 			mimeType := "text/gemini"
-			content, exists := getGemtextContent(geminiDataPath)
+			content, exists := getGemtextContent(urlPath)
 			if exists {
 				err := sendGeminiResponseHeader(conn, STATUS_SUCCESS, mimeType)
 				if err == nil {
-					conn.Write(content)
+					conn.Write(addGemtextNavigation(urlPath, content))
 				}
 			} else {
 				sendGeminiResponseHeader(conn, STATUS_NOT_FOUND, "Page Not Found")
@@ -165,13 +169,24 @@ func handleGeminiResponseBody(conn net.Conn, urlPath, host string) {
 			conn.Write([]byte(createRSSFeed("gemini://" + host)))
 		}
 	} else {
-		handleGeminiServeFile(conn, geminiDataPath)
+		handleGeminiServeFile(conn, urlPath)
 	}
 }
 
 func handleGeminiServeFile(conn net.Conn, path string) {
 	mimeType := getMIMEType(path)
-	f, err := os.Open(path)
+	f, err := openGeminiContentFile(path)
+	if err != nil && path == "/robots.txt" {
+		// A real robots.txt takes precedence over the generated one
+		if robots := generateRobotsTxt(ROBOTS_PROTOCOL_GEMINI,
+			""); robots != "" {
+			if sendGeminiResponseHeader(conn, STATUS_SUCCESS,
+				"text/plain; charset=utf-8") == nil {
+				conn.Write([]byte(robots))
+			}
+			return
+		}
+	}
 	if err != nil {
 		sendGeminiResponseHeader(conn, STATUS_NOT_FOUND, "Page Not Found")
 		return
@@ -184,12 +199,21 @@ func handleGeminiServeFile(conn net.Conn, path string) {
 	sendGeminiResponseBody(conn, f)
 }
 
-// Get Gemtext content from <path>.gmi or <path>.gemini
+// Get Gemtext content from <path>.gmi or <path>.gemini in the Gemini
+// capsule content, without the front matter
 func getGemtextContent(path string) (content []byte, exists bool) {
+	_, content, exists = getGemtextPage(path)
+	return
+}
+
+// Get the front matter and Gemtext content from <path>.gmi or
+// <path>.gemini in the Gemini capsule content
+func getGemtextPage(path string) (frontMatter map[string]string,
+	content []byte, exists bool) {
 	var err error
 	geminiExtensions := []string{".gmi", ".gemini"}
 	for _, extension := range geminiExtensions {
-		content, err = os.ReadFile(path + extension)
+		content, err = readGeminiContentFile(path + extension)
 		if err == nil {
 			exists = true
 		}
@@ -197,32 +221,72 @@ func getGemtextContent(path string) (content []byte, exists bool) {
 			break
 		}
 	}
+	if exists {
+		frontMatter, content = parseFrontMatter(content)
+	}
+	return
+}
+
+// Get the file info of <path>.gmi or <path>.gemini in the Gemini capsule
+// content
+func statGemtextFile(path string) (info fs.FileInfo, exists bool) {
+	for _, extension := range []string{".gmi", ".gemini"} {
+		info, err := fs.Stat(getGeminiContent(), contentName(path+extension))
+		if err == nil && !info.IsDir() {
+			return info, true
+		}
+	}
 	return
 }
 
 // Start Gemini capsule
 func startGeminiServer() {
-	cert := loadTLSCert()
-	geminiHostList = getDomainList()
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-	network, location := parseLocation(configData.Gemini.ListeningLocation)
-	if network == "unix" {
-		syscall.Unlink(location)
+	setGeminiTLSCert(loadTLSCert())
+	setGeminiHostList()
+	go watchGeminiTLSCertFiles()
+	tlsConfig := &tls.Config{GetCertificate: getGeminiTLSCert}
+	geminiListener.listen = func(location string) (net.Listener, error) {
+		ln, err := listenLocation(location)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(ln, tlsConfig), nil
 	}
-	ln, err := tls.Listen(network, location, tlsConfig)
+	geminiListener.serve = serveGemini
+	err := geminiListener.start(configData.Gemini.ListeningLocation)
 	handleErr(err, fmt.Sprintf("Unable to create Gemini capsule network at %s", configData.Gemini.ListeningLocation))
+}
+
+// Accept Gemini capsule connections until ln is closed
+func serveGemini(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			return
 		}
 		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		trackGeminiConnection(conn, true)
 		go handleGeminiConnection(conn)
 	}
 }
 
+// Add or remove an open Gemini capsule connection, so they can be waited
+// for when shutting down
+func trackGeminiConnection(conn net.Conn, open bool) {
+	geminiConnectionsLock.Lock()
+	defer geminiConnectionsLock.Unlock()
+	if open {
+		geminiConnections[conn] = struct{}{}
+		geminiConnectionsDone.Add(1)
+	} else if _, ok := geminiConnections[conn]; ok {
+		delete(geminiConnections, conn)
+		geminiConnectionsDone.Done()
+	}
+}
+
 // Handle client connection to Gemini capsule
 func handleGeminiConnection(conn net.Conn) {
+	defer trackGeminiConnection(conn, false)
 	defer conn.Close()
 	rBuf := make([]byte, 2048)
 	n, err := conn.Read(rBuf)
@@ -232,16 +296,27 @@ func handleGeminiConnection(conn net.Conn) {
 	handleGeminiRequest(conn, string(rBuf[:n]))
 }
 
+// Set the hosts the Gemini capsule accepts requests for from the domain
+// names of the gemini capsule
+func setGeminiHostList() {
+	geminiHostListLock.Lock()
+	defer geminiHostListLock.Unlock()
+	geminiHostList = getDomainList()
+}
+
 // Get port of gemini host requested along with if the host is valid
 func getGeminiHostPortValid(requestHost string) (port string, validHost bool) {
+	geminiHostListLock.RLock()
+	defer geminiHostListLock.RUnlock()
+	config := getConfig()
 	for _, host := range geminiHostList {
 		if strings.ToLower(requestHost) == host {
 			validHost = true
-			if host == torAddress {
-				port = strconv.Itoa(configData.Gemini.Tor.VirtualPort)
+			if host == getTorAddress() {
+				port = strconv.Itoa(config.Gemini.Tor.VirtualPort)
 				break
 			}
-			urlPath := "//" + configData.Gemini.ListeningLocation
+			urlPath := "//" + config.Gemini.ListeningLocation
 			serverLocation, err := url.Parse(urlPath)
 			if err == nil {
 				port = serverLocation.Port()
@@ -1,7 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// Line that starts and ends the front matter at the top of a Gemtext
+	// page
+	FRONT_MATTER_DELIMITER = "---"
+	// Longest page description taken from the first paragraph, in
+	// characters
+	DESCRIPTION_MAX_LENGTH = 160
 )
 
 const (
@@ -82,3 +95,97 @@ func parseGemtextLine(line string, preformattedToggle bool) (g gemtextLine) {
 	}
 	return
 }
+
+// Split the YAML front matter between --- lines at the top of a Gemtext page
+// from the page content.  Pages without valid front matter are returned
+// unchanged
+func parseFrontMatter(content []byte) (frontMatter map[string]string,
+	body []byte) {
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	if !strings.HasPrefix(text, FRONT_MATTER_DELIMITER+"\n") {
+		return nil, content
+	}
+	text = text[len(FRONT_MATTER_DELIMITER)+1:]
+	end := strings.Index("\n"+text, "\n"+FRONT_MATTER_DELIMITER+"\n")
+	if end < 0 {
+		if !strings.HasSuffix(text, "\n"+FRONT_MATTER_DELIMITER) {
+			return nil, content
+		}
+		end = len(text) - len(FRONT_MATTER_DELIMITER)
+	}
+	fields := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(text[:end]), &fields); err != nil {
+		return nil, content
+	}
+	frontMatter = map[string]string{}
+	for key, value := range fields {
+		frontMatter[key] = fmt.Sprint(value)
+	}
+	body = []byte(strings.TrimPrefix(text[end:],
+		FRONT_MATTER_DELIMITER))
+	body = []byte(strings.TrimPrefix(string(body), "\n"))
+	return frontMatter, body
+}
+
+// Get the text of the first level 1 heading of a Gemtext page
+func gemtextTitle(gmi string) string {
+	preformattedToggle := false
+	for _, line := range strings.Split(gmi, "\n") {
+		g := parseGemtextLine(strings.TrimSuffix(line, "\r"),
+			preformattedToggle)
+		if g.lineType == GEMTEXT_PREFORMATTED_TOGGLE {
+			preformattedToggle = !preformattedToggle
+		}
+		if g.lineType == GEMTEXT_HEADING && g.level == 1 {
+			return g.text
+		}
+	}
+	return ""
+}
+
+// Get a description of a Gemtext page from its first text line, shortened
+// at a word boundary
+func gemtextDescription(gmi string) string {
+	preformattedToggle := false
+	for _, line := range strings.Split(gmi, "\n") {
+		g := parseGemtextLine(strings.TrimSuffix(line, "\r"),
+			preformattedToggle)
+		if g.lineType == GEMTEXT_PREFORMATTED_TOGGLE {
+			preformattedToggle = !preformattedToggle
+		}
+		if g.lineType != GEMTEXT_TEXT || g.text == "" {
+			continue
+		}
+		if utf8.RuneCountInString(g.text) <= DESCRIPTION_MAX_LENGTH {
+			return g.text
+		}
+		description := string([]rune(g.text)[:DESCRIPTION_MAX_LENGTH])
+		if i := strings.LastIndex(description, " "); i > 0 {
+			description = description[:i]
+		}
+		return description + "…"
+	}
+	return ""
+}
+
+// A heading line of a Gemtext page
+type gemtextHeading struct {
+	level int
+	text  string
+}
+
+// Get the heading lines of a Gemtext page in order
+func gemtextHeadings(gmi string) (headings []gemtextHeading) {
+	preformattedToggle := false
+	for _, line := range strings.Split(gmi, "\n") {
+		g := parseGemtextLine(strings.TrimSuffix(line, "\r"),
+			preformattedToggle)
+		if g.lineType == GEMTEXT_PREFORMATTED_TOGGLE {
+			preformattedToggle = !preformattedToggle
+		}
+		if g.lineType == GEMTEXT_HEADING {
+			headings = append(headings, gemtextHeading{g.level, g.text})
+		}
+	}
+	return
+}
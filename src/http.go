@@ -1,16 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
+	"unicode"
 )
 
 const (
@@ -18,8 +20,8 @@ const (
 )
 
 var (
-	geminiContentRe = regexp.MustCompile("(?m)^\\s*%GEMINI_CONTENT%")
-	titleRe         = regexp.MustCompile("%TITLE%")
+	httpServer  *http.Server
+	httpsServer *http.Server
 )
 
 func catchAll(w http.ResponseWriter, r *http.Request) {
@@ -38,63 +40,205 @@ func catchAll(w http.ResponseWriter, r *http.Request) {
 		url = "/index"
 	}
 	if urlExtension == "" {
+		baseURL := requestBaseURL(r)
 		if !isRSSFeed(url) {
-			content, pageTitle, exists := geminiToHTMLFileContent(configData.Gemini.DataPath +
-				"/" + url)
+			// Validators come from the Gemtext file and the layout, so
+			// unchanged pages are not rendered again
+			contentType := getMIMEType(".html")
+			etag, modTime, exists := htmlPageETag(url, baseURL)
+			var htmlPage []byte
+			var err error
+			// The ETag of a 304 response is the ETag of the content
+			// encoding variant, which depends on the page size
+			size, known := getGeneratedSize(etag)
+			if exists && !known {
+				htmlPage, exists, err = renderHTMLPage(url, baseURL)
+				size = int64(len(htmlPage))
+				if err == nil && exists {
+					setGeneratedSize(etag, size)
+				}
+			}
+			if err == nil && exists && handleNotModified(w, r, contentType,
+				encodedETag(etag, responseEncoding(w, r, contentType, size)),
+				modTime) {
+				return
+			}
+			if err == nil && htmlPage == nil {
+				htmlPage, exists, err = renderHTMLPage(url, baseURL)
+			}
+			if err != nil {
+				logError("Unable to render %s: %s", url, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 			if exists {
-				w.Header().Set("content-type", getMIMEType(".html"))
-				w.WriteHeader(http.StatusOK)
-				htmlLayoutContent, err := os.ReadFile(configData.HTTP.LayoutHTMLPath)
-				handleErr(err, "Unable to read Layout HTML file")
-				htmlLayoutContent = titleRe.ReplaceAll(htmlLayoutContent, pageTitle)
-				htmlLayoutContent = geminiContentRe.ReplaceAll(htmlLayoutContent, content)
-				w.Write(htmlLayoutContent)
+				w.Header().Set("content-type", contentType)
+				serveCompressed(w, r, contentType,
+					int64(len(htmlPage)), func(w http.ResponseWriter) {
+						http.ServeContent(w, r, "", modTime,
+							bytes.NewReader(htmlPage))
+					})
 				return
 			}
 			w.WriteHeader(http.StatusNotFound)
 			return
 		} else {
-			w.Header().Set("content-type", "application/rss+xml")
-			w.WriteHeader(http.StatusOK)
-			rssHost := "http"
-			if r.TLS != nil {
-				rssHost += "s"
+			rssHost := baseURL
+			// The feed links depend on the requested host
+			var modTime time.Time
+			var feed string
+			if sourceInfo, exists := statGemtextFile(
+				getConfig().RSS.FeedSourceGeminiPath); exists {
+				var etag string
+				etag, modTime = generatedETag([]fs.FileInfo{sourceInfo},
+					rssHost)
+				size, known := getGeneratedSize(etag)
+				if !known {
+					feed = createRSSFeed(rssHost)
+					size = int64(len(feed))
+					setGeneratedSize(etag, size)
+				}
+				if handleNotModified(w, r, "application/rss+xml",
+					encodedETag(etag, responseEncoding(w, r,
+						"application/rss+xml", size)), modTime) {
+					return
+				}
 			}
-			rssHost += "://" + r.Host
-			w.Write([]byte(createRSSFeed(rssHost)))
+			if feed == "" {
+				feed = createRSSFeed(rssHost)
+			}
+			w.Header().Set("content-type", "application/rss+xml")
+			serveCompressed(w, r, "application/rss+xml", int64(len(feed)),
+				func(w http.ResponseWriter) {
+					http.ServeContent(w, r, "", modTime,
+						strings.NewReader(feed))
+				})
 			return
 		}
 	}
 	handleHTTPFile(w, r, url)
 }
 
+// Serve the file at URL path path from the Gemini capsule content or else
+// the HTTP data path.  Files outside the data roots and denied names are
+// not found
 func handleHTTPFile(w http.ResponseWriter, r *http.Request, path string) {
-	geminiDataPath := configData.Gemini.DataPath + "/" + path
-	httpDataPath := configData.HTTP.DataPath + "/" + path
-	f, err := os.Open(geminiDataPath)
+	gf, err := openGeminiContentFile(path)
 	if err == nil {
-		defer f.Close()
-		w.Header().Set("content-type", getMIMEType(path))
-		w.WriteHeader(http.StatusOK)
-		io.Copy(w, f)
+		defer gf.Close()
+		serveHTTPFile(w, r, path, gf, "")
 		return
 	}
-	f, err = os.Open(httpDataPath)
+	httpDataRoot := dataRoot(getConfig().HTTP.DataPath)
+	name := contentName(path)
+	if hasPrecompressedFile(httpDataRoot, name) {
+		addVaryAcceptEncoding(w)
+		if f, encoding := openPrecompressedFile(r, httpDataRoot,
+			name); f != nil {
+			defer f.Close()
+			serveHTTPFile(w, r, path, f, encoding)
+			return
+		}
+	}
+	f, err := httpDataRoot.Open(name)
 	if err == nil {
 		defer f.Close()
-		w.Header().Set("content-type", getMIMEType(path))
-		w.WriteHeader(http.StatusOK)
-		io.Copy(w, f)
+		serveHTTPFile(w, r, path, f, "")
+		return
+	}
+	if serveGeneratedHTTPFile(w, r, path) {
 		return
 	}
 	w.WriteHeader(http.StatusNotFound)
 }
 
-func geminiToHTMLFileContent(path string) (content, pageTitle []byte, exists bool) {
-	var gmiContent []byte
-	gmiContent, exists = getGemtextContent(path)
-	content, pageTitle = translateGemtextToHTML(string(gmiContent))
-	return
+// Get the scheme and host of a request
+func requestBaseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// Serve the generated robots.txt and sitemap.xml, unless they are turned
+// off.  Real files in the data paths take precedence.  Returns false if
+// there is no generated file at URL path path
+func serveGeneratedHTTPFile(w http.ResponseWriter, r *http.Request,
+	path string) bool {
+	config := getConfig()
+	baseURL := getHTTPBaseURL(requestBaseURL(r))
+	var content []byte
+	contentType := "text/plain; charset=utf-8"
+	switch {
+	case path == "/robots.txt":
+		sitemapURL := ""
+		if config.HTTP.SitemapEnabled {
+			sitemapURL = baseURL + SITEMAP_PATH
+		}
+		content = []byte(generateRobotsTxt(ROBOTS_PROTOCOL_HTTP, sitemapURL))
+	case path == SITEMAP_PATH && config.HTTP.SitemapEnabled:
+		var err error
+		content, err = generateSitemap(baseURL, false)
+		if err != nil {
+			logError("Unable to generate %s: %s", SITEMAP_PATH, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return true
+		}
+		contentType = "application/xml"
+	}
+	if len(content) == 0 {
+		return false
+	}
+	w.Header().Set("content-type", contentType)
+	setCacheHeaders(w, contentType, "", time.Time{})
+	serveCompressed(w, r, contentType, int64(len(content)),
+		func(w http.ResponseWriter) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		})
+	return true
+}
+
+// Serve file f with Content-Length and support for HEAD, Range, If-Range
+// and conditional requests.  *os.File content is sent with sendfile where
+// the OS supports it.  encoding is the content encoding of precompressed
+// files, otherwise compressible content is compressed on the fly
+func serveHTTPFile(w http.ResponseWriter, r *http.Request, name string,
+	f fs.File, encoding string) {
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	content, seekable := f.(io.ReadSeeker)
+	if !seekable {
+		// Files of sealed content are compressed in memory and can't seek
+		b, err := io.ReadAll(f)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+	contentType := getMIMEType(name)
+	if contentType == "" && encoding != "" {
+		// Compressed content can't be sniffed
+		contentType = "application/octet-stream"
+	}
+	if contentType != "" {
+		// Otherwise the content type is sniffed from the content
+		w.Header().Set("content-type", contentType)
+	}
+	setCacheHeaders(w, contentType, encodedETag(fileETag(info), encoding),
+		info.ModTime())
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		http.ServeContent(w, r, name, info.ModTime(), content)
+		return
+	}
+	serveCompressed(w, r, contentType, info.Size(),
+		func(w http.ResponseWriter) {
+			http.ServeContent(w, r, name, info.ModTime(), content)
+		})
 }
 
 func escapeHTMLContent(content string) string {
@@ -110,91 +254,219 @@ func escapeHTMLQuotes(content string) string {
 	return content
 }
 
-func translateGemtextToHTML(gmi string) (html, pageTitle []byte) {
-	pageTitle = []byte(configData.HTTP.DefaultPageTitle)
-	htmlString := "<div id=\"content\">\n"
+// Get the id of a heading from its text, lowercase letters and digits
+// joined by hyphens.  ids are unique within a page, later headings with the
+// same text get a -2, -3... suffix
+func headingSlug(text string, ids map[string]bool) string {
+	var slug strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			slug.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	id := slug.String()
+	if id == "" {
+		id = "section"
+	}
+	base := id
+	for i := 2; ids[id]; i++ {
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+	ids[id] = true
+	return id
+}
+
+// Translate Gemtext into HTML5.  Consecutive list items are grouped into a
+// list, consecutive quote lines into one quote, and consecutive text lines
+// into one paragraph, with blank lines separating paragraphs.  Headings get
+// slug ids to link to.  pageTitle is the text of the first level 1 heading
+// or the default page title
+func translateGemtextToHTML(gmi string) (html []byte, pageTitle string) {
+	pageTitle = getConfig().HTTP.DefaultPageTitle
+	var htmlString strings.Builder
+	htmlString.WriteString("<div id=\"content\">\n")
 	gmi = strings.ReplaceAll(gmi, "\r\n", "\n")
-	gmiLines := strings.Split(gmi, "\n")
+	gmiLines := strings.Split(strings.TrimSuffix(gmi, "\n"), "\n")
 	preformattedToggle := false
+	preformattedLines := 0
 	pageTitleSet := false
+	headingIDs := map[string]bool{}
+	// The HTML element of the open group of lines, "ul", "p" or
+	// "blockquote", and if the quote has an open paragraph
+	openBlock := ""
+	quoteParagraph := false
+	closeBlock := func() {
+		switch openBlock {
+		case "ul":
+			htmlString.WriteString("</ul>\n")
+		case "p":
+			htmlString.WriteString("</p>\n")
+		case "blockquote":
+			if quoteParagraph {
+				htmlString.WriteString("</p>\n")
+			}
+			htmlString.WriteString("</blockquote>\n")
+		}
+		openBlock, quoteParagraph = "", false
+	}
 	for _, line := range gmiLines {
 		g := parseGemtextLine(line, preformattedToggle)
+		if g.lineType == GEMTEXT_PREFORMATTED_TEXT {
+			// The newline of the last line is left out
+			if preformattedLines > 0 {
+				htmlString.WriteString("\n")
+			}
+			htmlString.WriteString(escapeHTMLContent(g.text))
+			preformattedLines++
+			continue
+		}
+		switch {
+		case g.lineType == GEMTEXT_LIST_ITEM && openBlock == "ul",
+			g.lineType == GEMTEXT_QUOTE && openBlock == "blockquote",
+			g.lineType == GEMTEXT_TEXT && openBlock == "p" && g.text != "":
+		default:
+			closeBlock()
+		}
 		switch g.lineType {
 		case GEMTEXT_HEADING:
-			htmlString += fmt.Sprintf("<h%d>%s</h%d>\n", g.level,
-				escapeHTMLContent(g.text), g.level)
+			fmt.Fprintf(&htmlString, "<h%d id=\"%s\">%s</h%d>\n", g.level,
+				headingSlug(g.text, headingIDs), escapeHTMLContent(g.text),
+				g.level)
 			if g.level == 1 && !pageTitleSet {
-				pageTitle = []byte(escapeHTMLQuotes(g.text))
+				pageTitle = g.text
+				pageTitleSet = true
 			}
 		case GEMTEXT_LIST_ITEM:
-			htmlString += fmt.Sprintf("<li>%s</li>\n", escapeHTMLContent(g.text))
+			if openBlock == "" {
+				htmlString.WriteString("<ul>\n")
+				openBlock = "ul"
+			}
+			fmt.Fprintf(&htmlString, "<li>%s</li>\n", escapeHTMLContent(g.text))
 		case GEMTEXT_QUOTE:
-			htmlString += fmt.Sprintf("<blockquote>%s</blockquote>\n",
-				escapeHTMLContent(g.text))
+			if openBlock == "" {
+				htmlString.WriteString("<blockquote>\n")
+				openBlock = "blockquote"
+			}
+			switch {
+			case g.text == "" && quoteParagraph:
+				// Blank quote lines separate paragraphs of the quote
+				htmlString.WriteString("</p>\n")
+				quoteParagraph = false
+			case g.text == "":
+			case quoteParagraph:
+				fmt.Fprintf(&htmlString, "<br>\n%s", escapeHTMLContent(g.text))
+			default:
+				fmt.Fprintf(&htmlString, "<p>%s", escapeHTMLContent(g.text))
+				quoteParagraph = true
+			}
 		case GEMTEXT_TEXT:
-			if g.text == "" {
-				htmlString += "<br />\n"
-			} else {
-				htmlString += fmt.Sprintf("<p>%s</p>\n", escapeHTMLContent(g.text))
+			switch {
+			case g.text == "":
+				// Blank lines only separate paragraphs
+			case openBlock == "p":
+				fmt.Fprintf(&htmlString, "<br>\n%s", escapeHTMLContent(g.text))
+			default:
+				fmt.Fprintf(&htmlString, "<p>%s", escapeHTMLContent(g.text))
+				openBlock = "p"
 			}
 		case GEMTEXT_PREFORMATTED_TOGGLE:
 			if !preformattedToggle {
-				escapedAltText := escapeHTMLQuotes(escapeHTMLContent(g.altText))
-				htmlString += fmt.Sprintf("<pre aria-label=\"%s\" title=\"%s\"><code>",
-					escapedAltText, escapedAltText)
-			} else {
-				if strings.HasSuffix(htmlString, "\n") {
-					htmlString = htmlString[:len(htmlString)-1]
+				label := ""
+				if g.altText != "" {
+					altText := escapeHTMLQuotes(escapeHTMLContent(g.altText))
+					label = fmt.Sprintf(" aria-label=\"%s\" title=\"%s\"",
+						altText, altText)
 				}
-				htmlString += "</code></pre>\n"
+				fmt.Fprintf(&htmlString, "<pre%s><code>", label)
+				preformattedLines = 0
+			} else {
+				htmlString.WriteString("</code></pre>\n")
 			}
 			preformattedToggle = !preformattedToggle
-		case GEMTEXT_PREFORMATTED_TEXT:
-			htmlString += fmt.Sprintf("%s\n", escapeHTMLContent(g.text))
 		case GEMTEXT_LINK:
 			urlData, _ := url.Parse(g.path)
+			if urlData == nil {
+				urlData = &url.URL{}
+			}
+			href, rewritten := rewriteGemtextLink(g.path)
 			schemeText := ""
-			if urlData.Scheme == "gemini" {
+			if urlData.Scheme == "gemini" && !rewritten {
 				schemeText += " [Gemini Protocol Link]"
 			}
 			target := ""
-			if urlData.Host != "" {
+			if hrefData, err := url.Parse(href); err == nil &&
+				hrefData.Host != "" {
 				target = " target=\"_blank\""
 			}
 			switch {
 			case urlData.Scheme == "" && urlData.Host == "" &&
 				strings.HasPrefix(getMIMEType(g.path), "image/"):
-				htmlString += fmt.Sprintf("<div class=\"img-container\">"+
-					"<img src=\"%s\" alt=\"%s\" title=\"%s\"/></div>\n",
+				fmt.Fprintf(&htmlString, "<div class=\"img-container\">"+
+					"<img src=\"%s\" alt=\"%s\" title=\"%s\"></div>\n",
 					escapeHTMLQuotes(escapeHTMLContent(g.path)),
 					escapeHTMLQuotes(escapeHTMLContent(g.text)),
 					escapeHTMLQuotes(escapeHTMLContent(g.text)))
 			case g.text != "":
-				htmlString += fmt.Sprintf("<a href=\"%s\"%s>%s</a>%s<br />\n",
-					escapeHTMLQuotes(escapeHTMLContent(g.path)),
+				fmt.Fprintf(&htmlString, "<a href=\"%s\"%s>%s</a>%s<br>\n",
+					escapeHTMLQuotes(escapeHTMLContent(href)),
 					target,
 					escapeHTMLQuotes(escapeHTMLContent(g.text)),
 					schemeText)
 			default:
 				linkPath := escapeHTMLQuotes(escapeHTMLContent(g.path))
-				htmlString += fmt.Sprintf("<a href=\"%s\"%s>%s</a>%s<br />\n",
-					linkPath, target, linkPath, schemeText)
+				fmt.Fprintf(&htmlString, "<a href=\"%s\"%s>%s</a>%s<br>\n",
+					escapeHTMLQuotes(escapeHTMLContent(href)), target, linkPath,
+					schemeText)
 			}
 		}
 	}
-	html = []byte(htmlString + "</div>")
+	if preformattedToggle {
+		// The preformatted block was not closed before the end of the page
+		htmlString.WriteString("</code></pre>\n")
+	}
+	closeBlock()
+	html = []byte(htmlString.String() + "</div>")
 	return
 }
 
-func startHTTPServer() {
+// Start HTTP server
+func startHTTPServer() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", catchAll)
-	network, location := parseLocation(configData.HTTP.ListeningLocation)
-	srv := &http.Server{
+	// Answer ACME http-01 challenges and redirect to HTTPS if enabled
+	httpServer = &http.Server{
 		ReadTimeout: 5 * time.Second,
-		Handler:     mux,
+		Handler:     securityHeadersHandler(acmeHTTPHandler(mux)),
+	}
+	httpListener.listen = listenLocation
+	httpListener.serve = func(ln net.Listener) { httpServer.Serve(ln) }
+	return httpListener.start(configData.HTTP.ListeningLocation)
+}
+
+// Start HTTPS server with TLS certificates from the ACME certificate
+// manager
+func startHTTPSServer() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", catchAll)
+	httpsServer = &http.Server{
+		ReadTimeout: 5 * time.Second,
+		Handler:     securityHeadersHandler(mux),
+	}
+	httpsListener.listen = func(location string) (net.Listener, error) {
+		ln, err := listenLocation(location)
+		if err != nil {
+			return nil, err
+		}
+		// The TLS config answers ACME tls-alpn-01 challenges
+		return tls.NewListener(ln, acmeTLSConfig()), nil
 	}
-	networkListener, err := net.Listen(network, location)
-	handleErr(err, "Unable to start HTTP server")
-	srv.Serve(networkListener)
+	httpsListener.serve = func(ln net.Listener) { httpsServer.Serve(ln) }
+	return httpsListener.start(configData.HTTP.HTTPS.ListeningLocation)
 }
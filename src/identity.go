@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	IDENTITY_PASSPHRASE_ENV = "BERGELMIR_IDENTITY_PASSPHRASE"
+	IDENTITY_MANIFEST_FILE  = "manifest.yaml"
+	IDENTITY_CONFIG_FILE    = "config.yaml"
+	IDENTITY_ONION_KEY_FILE = "tor/hs_ed25519_secret_key"
+	IDENTITY_TLS_KEY_FILE   = "tls/cert.key"
+	IDENTITY_TLS_CERT_FILE  = "tls/cert.pem"
+	// Largest uncompressed file read from an identity bundle
+	IDENTITY_MAX_FILE_SIZE = 1024 * 1024
+)
+
+var (
+	// Files of an identity bundle, in the order they are written
+	identityFiles = []string{IDENTITY_MANIFEST_FILE, IDENTITY_CONFIG_FILE,
+		IDENTITY_ONION_KEY_FILE, IDENTITY_TLS_KEY_FILE, IDENTITY_TLS_CERT_FILE}
+)
+
+// Manifest of an identity bundle, used to check the bundle on import
+type identityManifest struct {
+	BergelmirVersion string `yaml:"bergelmir_version"`
+	Created          string `yaml:"created"`
+	OnionAddress     string `yaml:"onion_address"`
+	TLSCertSHA256    string `yaml:"tls_cert_sha256"`
+}
+
+// Run `bergelmir identity <subcommand>` and return the exit code
+func runIdentityCommand(subcommand string, args []string) int {
+	switch {
+	case subcommand == "export" && len(args) == 1:
+		return exportIdentity(args[0])
+	case subcommand == "import" && len(args) == 1:
+		return importIdentity(args[0])
+	default:
+		fmt.Printf("Usage: %s identity <subcommand> <path>\n\n", bergelmirCmd)
+		fmt.Println("Subcommands:")
+		fmt.Println("  export <path>  Write the tor hidden service private " +
+			"key, TLS private key and certificate and config file to a " +
+			"passphrase protected identity bundle")
+		fmt.Println("  import <path>  Restore the identity bundle at path")
+		fmt.Printf("\nThe identity bundle passphrase is read from $%s or "+
+			"a prompt\n", IDENTITY_PASSPHRASE_ENV)
+		if subcommand != "help" {
+			return EXIT_USAGE
+		}
+		return EXIT_SUCCESS
+	}
+}
+
+// Get the identity bundle passphrase from the identity passphrase
+// environment variable or a terminal prompt.  If confirm is true, a typed
+// passphrase has to be typed twice
+func getIdentityPassphrase(confirm bool) ([]byte, error) {
+	if passphrase := os.Getenv(IDENTITY_PASSPHRASE_ENV); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	passphrase, err := promptPassphrase("Identity bundle passphrase: ")
+	if err != nil || !confirm {
+		return passphrase, err
+	}
+	confirmation, err := promptPassphrase("Repeat identity bundle passphrase: ")
+	if err == nil && string(confirmation) != string(passphrase) {
+		err = errors.New("passphrases do not match")
+	}
+	return passphrase, err
+}
+
+// Get the onion address of the content of a tor hs_ed25519_secret_key file
+func onionAddressFromKeyFile(content []byte) (string, error) {
+	privKey, err := parseHiddenServiceV3PrivKeyFile(content)
+	if err != nil {
+		return "", err
+	}
+	return encodeHiddenServicePublicKey(hiddenServiceV3PubKey(privKey)), nil
+}
+
+// Get the hex SHA-256 fingerprint of a PEM encoded TLS certificate and
+// check that it belongs to the PEM encoded TLS private key
+func tlsCertFingerprint(certPEM, keyPEM []byte) (string, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Write the identity bundle to bundlePath.  Returns the exit code
+func exportIdentity(bundlePath string) int {
+	manifest := identityManifest{
+		BergelmirVersion: VERSION,
+		Created:          time.Now().UTC().Format(time.RFC3339),
+	}
+	files := map[string][]byte{}
+	configContent, err := os.ReadFile(configFilePath)
+	if err != nil {
+		logError("Unable to read config file %s: %s", configFilePath, err)
+		return EXIT_FAILURE
+	}
+	files[IDENTITY_CONFIG_FILE] = configContent
+	// Private keys are stored decrypted in the bundle, which is encrypted
+	// as a whole, so the bundle doesn't depend on the at rest passphrase
+	onionKey, err := readFileDecrypted(configData.Tor.HiddenServicePrivateKeyPath)
+	if err == nil {
+		manifest.OnionAddress, err = onionAddressFromKeyFile(onionKey)
+		if err != nil {
+			logError("Tor hidden service private key %s is corrupt: %s",
+				configData.Tor.HiddenServicePrivateKeyPath, err)
+			return EXIT_FAILURE
+		}
+		files[IDENTITY_ONION_KEY_FILE] = onionKey
+	} else if !errors.Is(err, os.ErrNotExist) {
+		logError("Unable to read tor hidden service private key %s: %s",
+			configData.Tor.HiddenServicePrivateKeyPath, err)
+		return EXIT_FAILURE
+	} else {
+		logInfo("- No tor hidden service private key at %s, skipping it",
+			configData.Tor.HiddenServicePrivateKeyPath)
+	}
+	tlsKey, keyErr := readFileDecrypted(configData.Gemini.TLS.KeyPath)
+	tlsCert, certErr := os.ReadFile(configData.Gemini.TLS.CertPath)
+	if keyErr == nil && certErr == nil {
+		manifest.TLSCertSHA256, err = tlsCertFingerprint(tlsCert, tlsKey)
+		if err != nil {
+			logError("TLS certificate %s and TLS private key %s don't "+
+				"match: %s", configData.Gemini.TLS.CertPath,
+				configData.Gemini.TLS.KeyPath, err)
+			return EXIT_FAILURE
+		}
+		files[IDENTITY_TLS_KEY_FILE] = tlsKey
+		files[IDENTITY_TLS_CERT_FILE] = tlsCert
+	} else {
+		logInfo("- No TLS certificate and private key, skipping them")
+	}
+	manifestContent, err := yaml.Marshal(&manifest)
+	if err != nil {
+		logError("Unable to create identity bundle manifest: %s", err)
+		return EXIT_FAILURE
+	}
+	files[IDENTITY_MANIFEST_FILE] = manifestContent
+	passphrase, err := getIdentityPassphrase(true)
+	if err != nil {
+		logError("Unable to get identity bundle passphrase: %s", err)
+		return EXIT_FAILURE
+	}
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	for _, name := range identityFiles {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		w, err := zipWriter.Create(name)
+		if err == nil {
+			_, err = w.Write(content)
+		}
+		if err != nil {
+			logError("Unable to create identity bundle: %s", err)
+			return EXIT_FAILURE
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		logError("Unable to create identity bundle: %s", err)
+		return EXIT_FAILURE
+	}
+	bundle, err := encryptData(archive.Bytes(), passphrase)
+	if err == nil {
+		err = writeFileAtomic(bundlePath, bundle)
+	}
+	if err != nil {
+		logError("Unable to write identity bundle %s: %s", bundlePath, err)
+		return EXIT_FAILURE
+	}
+	logInfo("- Wrote identity bundle to %s", bundlePath)
+	if manifest.OnionAddress != "" {
+		logInfo("- Onion address is %s", manifest.OnionAddress)
+	}
+	return EXIT_SUCCESS
+}
+
+// Restore the identity bundle at bundlePath.  Returns the exit code
+func importIdentity(bundlePath string) int {
+	bundle, err := os.ReadFile(bundlePath)
+	if err != nil {
+		logError("Unable to read identity bundle %s: %s", bundlePath, err)
+		return EXIT_FAILURE
+	}
+	passphrase, err := getIdentityPassphrase(false)
+	if err != nil {
+		logError("Unable to get identity bundle passphrase: %s", err)
+		return EXIT_FAILURE
+	}
+	archive, err := decryptData(bundle, passphrase)
+	if err != nil {
+		logError("Unable to decrypt identity bundle %s: %s", bundlePath, err)
+		return EXIT_FAILURE
+	}
+	files, err := readZipFiles(archive, identityFiles, IDENTITY_MAX_FILE_SIZE)
+	if err != nil {
+		logError("Unable to read identity bundle %s: %s", bundlePath, err)
+		return EXIT_FAILURE
+	}
+	manifest := identityManifest{}
+	if err := yaml.Unmarshal(files[IDENTITY_MANIFEST_FILE], &manifest); err != nil {
+		logError("Unable to read identity bundle manifest: %s", err)
+		return EXIT_FAILURE
+	}
+	// Check the bundle before anything is written
+	if onionKey, ok := files[IDENTITY_ONION_KEY_FILE]; ok {
+		onionAddress, err := onionAddressFromKeyFile(onionKey)
+		if err != nil || onionAddress != manifest.OnionAddress {
+			logError("Tor hidden service private key in identity bundle "+
+				"does not belong to onion address %s", manifest.OnionAddress)
+			return EXIT_FAILURE
+		}
+		logInfo("- Onion address is %s", onionAddress)
+	}
+	if tlsKey, ok := files[IDENTITY_TLS_KEY_FILE]; ok {
+		fingerprint, err := tlsCertFingerprint(files[IDENTITY_TLS_CERT_FILE],
+			tlsKey)
+		if err != nil || fingerprint != manifest.TLSCertSHA256 {
+			logError("TLS certificate in identity bundle does not match " +
+				"the TLS private key or manifest")
+			return EXIT_FAILURE
+		}
+	}
+	// Use the existing config file paths if there is one, otherwise restore
+	// the config file from the identity bundle
+	if fileExists(configFilePath) {
+		writeFile(configFilePath+".imported", files[IDENTITY_CONFIG_FILE])
+		logInfo("- Kept existing config file %s, wrote the config file from "+
+			"the identity bundle to %s", configFilePath,
+			configFilePath+".imported")
+	} else {
+		if err := yaml.Unmarshal(files[IDENTITY_CONFIG_FILE], &configData); err != nil {
+			logError("Unable to parse config file in identity bundle: %s", err)
+			return EXIT_FAILURE
+		}
+		writeFile(configFilePath, files[IDENTITY_CONFIG_FILE])
+		logInfo("- Restored config file %s", configFilePath)
+	}
+	if onionKey, ok := files[IDENTITY_ONION_KEY_FILE]; ok {
+		if !importPrivateKeyFile(configData.Tor.HiddenServicePrivateKeyPath,
+			onionKey, "tor hidden service private key") {
+			return EXIT_FAILURE
+		}
+	}
+	if tlsKey, ok := files[IDENTITY_TLS_KEY_FILE]; ok {
+		if !importPrivateKeyFile(configData.Gemini.TLS.KeyPath, tlsKey,
+			"TLS private key") {
+			return EXIT_FAILURE
+		}
+		createFileDirectory(configData.Gemini.TLS.CertPath)
+		if err := writeTLSCert(files[IDENTITY_TLS_CERT_FILE]); err != nil {
+			logError("Unable to restore TLS certificate: %s", err)
+			return EXIT_FAILURE
+		}
+		logInfo("- Restored TLS certificate %s",
+			configData.Gemini.TLS.CertPath)
+	}
+	return EXIT_SUCCESS
+}
+
+// Write an imported private key to path.  An existing different private key
+// is only replaced if confirmed, and is kept at <path>.bak.  Returns false
+// if the private key was not written
+func importPrivateKeyFile(path string, content []byte, name string) bool {
+	existing, err := readFileDecrypted(path)
+	if err == nil && bytes.Equal(existing, content) {
+		logInfo("- Existing %s %s is the same, skipping it", name, path)
+		return true
+	}
+	if fileExists(path) {
+		if !getUserInputYN("", fmt.Sprintf("Replace existing %s %s? [y/N]: ",
+			name, path), false) {
+			logError("Not replacing existing %s %s", name, path)
+			return false
+		}
+		if err := os.Rename(path, path+".bak"); err != nil {
+			logError("Unable to move existing %s to %s.bak: %s", name, path,
+				err)
+			return false
+		}
+		logInfo("- Moved existing %s to %s.bak", name, path)
+	}
+	createFileDirectory(path)
+	if err := writePrivateKeyFile(path, content); err != nil {
+		logError("Unable to write %s %s: %s", name, path, err)
+		return false
+	}
+	logInfo("- Restored %s %s", name, path)
+	return true
+}
+
+// Read the files of a zip archive into memory.  Only the files in names of
+// at most maxSize bytes are accepted, so a crafted archive can't use up all
+// memory
+func readZipFiles(archive []byte, names []string,
+	maxSize int64) (map[string][]byte, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(archive),
+		int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+	if len(zipReader.File) > len(names) {
+		return nil, fmt.Errorf("%d files instead of at most %d",
+			len(zipReader.File), len(names))
+	}
+	files := map[string][]byte{}
+	for _, zipFile := range zipReader.File {
+		if !stringInSlice(zipFile.Name, names) {
+			return nil, fmt.Errorf("unexpected file %s", zipFile.Name)
+		}
+		if _, exists := files[zipFile.Name]; exists {
+			return nil, fmt.Errorf("duplicate file %s", zipFile.Name)
+		}
+		if zipFile.UncompressedSize64 > uint64(maxSize) {
+			return nil, fmt.Errorf("%s is larger than %d bytes",
+				zipFile.Name, maxSize)
+		}
+		f, err := zipFile.Open()
+		if err != nil {
+			return nil, err
+		}
+		// The uncompressed size in the archive is not to be trusted
+		content, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(content)) > maxSize {
+			return nil, fmt.Errorf("%s is larger than %d bytes",
+				zipFile.Name, maxSize)
+		}
+		files[zipFile.Name] = content
+	}
+	return files, nil
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	_ "embed"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -17,52 +21,239 @@ var (
 	defaultTorrcFileContent []byte
 )
 
+// Init prompt answer keys, used as init flag names and answers file keys
+var initAnswerKeys = []struct {
+	key         string
+	description string
+}{
+	{"overwrite", "overwrite an existing config file (y/n)"},
+	{"tor-enabled", "enable Tor \".onion\" address (y/n)"},
+	{"gemini-port", "Gemini capsule listening port"},
+	{"gemini-localhost", "limit Gemini capsule reachability to localhost (y/n)"},
+	{"gemini-domain-names", "space separated domain names of the Gemini capsule"},
+	{"gemini-data-path", "path for Gemini capsule files"},
+	{"tls-key-type", "TLS key type (" + strings.Join(tlsKeyTypes, ", ") + ")"},
+	{"tls-common-name", "TLS certificate subject common name"},
+	{"tls-validity-days", "TLS certificate validity in days (0 for valid until 2200)"},
+	{"encrypt-keys", "encrypt TLS and Tor private keys with a passphrase (y/n)"},
+	{"passphrase-file", "passphrase file path for encrypted private keys"},
+	{"tor-gemini-port", "Tor listening port for the Gemini capsule"},
+	{"tor-use-bridges", "connect to Tor using bridges (y/n)"},
+	{"tor-bridges", "Tor bridge line (repeat for more bridge lines)"},
+	{"tor-transport-obfs4", "path to the obfs4 pluggable transport binary"},
+	{"tor-transport-meek_lite", "path to the meek_lite pluggable transport binary"},
+	{"tor-transport-snowflake", "path to the snowflake pluggable transport binary"},
+	{"tor-transport-webtunnel", "path to the webtunnel pluggable transport binary"},
+	{"rss-enabled", "enable RSS feed at /rss and /feed URLs (y/n)"},
+	{"rss-feed-source", "Gemini source path for the RSS feed"},
+	{"http-enabled", "enable HTTP server (y/n)"},
+	{"http-port", "HTTP server listening port"},
+	{"http-localhost", "limit HTTP server reachability to localhost (y/n)"},
+	{"http-data-path", "path for HTTP server files"},
+	{"http-page-title", "default HTML page title"},
+	{"tor-http-port", "Tor listening port for the HTTP server"},
+	{"https-enabled", "enable HTTPS server with ACME certificates (y/n)"},
+	{"https-port", "HTTPS server listening port"},
+	{"acme-domain-names", "space separated domain names for ACME certificates"},
+	{"acme-directory-url", "ACME directory URL"},
+	{"acme-challenge", "ACME challenge type (tls-alpn-01 or http-01)"},
+	{"acme-email", "contact email for the ACME account"},
+	{"acme-accept-tos", "accept the terms of service of the ACME CA (y/n)"},
+	{"https-redirect-http", "redirect HTTP requests for the ACME domain names to HTTPS (y/n)"},
+}
+
+var (
+	stdinReader = bufio.NewReader(os.Stdin)
+	// Answers to init prompts from init flags or an answers file, by answer
+	// key
+	initAnswers = map[string]string{}
+	// Init flag answers, which take precedence over the answers file
+	initFlagAnswers = map[string]string{}
+	// Use the default value for init prompts without an answer
+	initUseDefaults bool
+	// Never read init prompt answers from stdin
+	initNonInteractive  bool
+	initAnswersFilePath string
+	// Missing and invalid init answers
+	initAnswerErrors []string
+)
+
+// Add the init answer flags to fs
+func addInitFlags(fs *flag.FlagSet) {
+	fs.StringVar(&initAnswersFilePath, "answers", "",
+		"YAML file with answers to the init prompts, by flag name")
+	fs.BoolVar(&initUseDefaults, "defaults", false,
+		"use the default value for prompts without an answer")
+	fs.BoolVar(&initNonInteractive, "non-interactive", false,
+		"fail instead of prompting for missing answers (default if stdin "+
+			"is not a terminal)")
+	for _, answerKey := range initAnswerKeys {
+		key := answerKey.key
+		fs.Func(key, answerKey.description, func(value string) error {
+			if existing, ok := initFlagAnswers[key]; ok && key == "tor-bridges" {
+				value = existing + "\n" + value
+			}
+			initFlagAnswers[key] = value
+			return nil
+		})
+	}
+}
+
+// Check if key is an init answer key
+func isInitAnswerKey(key string) bool {
+	if strings.HasPrefix(key, "tor-transport-") {
+		return true
+	}
+	for _, answerKey := range initAnswerKeys {
+		if answerKey.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Read init answers from the YAML answers file at path.  Lists are
+// joined with newlines
+func readInitAnswersFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	answers := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &answers); err != nil {
+		return err
+	}
+	for key, value := range answers {
+		if !isInitAnswerKey(key) {
+			return fmt.Errorf("unknown answer %q", key)
+		}
+		switch v := value.(type) {
+		case nil:
+			initAnswers[key] = ""
+		case bool:
+			initAnswers[key] = "n"
+			if v {
+				initAnswers[key] = "y"
+			}
+		case []interface{}:
+			lines := []string{}
+			for _, item := range v {
+				lines = append(lines, fmt.Sprint(item))
+			}
+			initAnswers[key] = strings.Join(lines, "\n")
+		default:
+			initAnswers[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// Run `bergelmir init` after its flags are parsed.  Returns the exit code
+func runInit() int {
+	if initAnswersFilePath != "" {
+		if err := readInitAnswersFile(initAnswersFilePath); err != nil {
+			logError("Unable to read init answers file %s: %s",
+				initAnswersFilePath, err)
+			return EXIT_USAGE
+		}
+	}
+	for key, value := range initFlagAnswers {
+		initAnswers[key] = value
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		initNonInteractive = true
+	}
+	return initBergelmirProject()
+}
+
+// Add a missing or invalid init answer error for the prompt with answer key
+func addInitAnswerError(key, prompt, msg string) {
+	prompt = strings.TrimSpace(prompt)
+	if i := strings.Index(prompt, " ["); i >= 0 {
+		prompt = prompt[:i]
+	}
+	prompt = strings.TrimSuffix(strings.TrimSpace(prompt), ":")
+	initAnswerErrors = append(initAnswerErrors,
+		fmt.Sprintf("--%s: %s (%s)", key, msg, prompt))
+}
+
+// Get the answer for the init prompt with answer key from the init answers.
+// answered is false if the answer has to be read from stdin instead.  A
+// missing answer is blank so the default value is used
+func getInitAnswer(key, prompt string) (answer string, answered bool) {
+	if key == "" {
+		return "", false
+	}
+	if answer, answered = initAnswers[key]; answered {
+		return strings.TrimSpace(answer), true
+	}
+	if !initUseDefaults && initNonInteractive {
+		addInitAnswerError(key, prompt, "missing answer")
+	}
+	return "", initUseDefaults || initNonInteractive
+}
+
 // Get user input from stdin (newline terminated)
 func getUserInput(prompt string) string {
 	fmt.Print(prompt)
-	reader := bufio.NewReader(os.Stdin)
-	input, err := reader.ReadString('\n')
+	input, err := stdinReader.ReadString('\n')
 	handleErr(err, "Unable to read user input from terminal")
-	return (strings.TrimSuffix(input, "\n"))
+	return strings.TrimSuffix(strings.TrimSuffix(input, "\n"), "\r")
 }
 
-// Get user text input from stdin otherwise defaultVal if the input is blank
-func getUserInputText(prompt, defaultVal string) string {
-	t := getUserInput(prompt)
+// Get user text input for answer key from the init answers or stdin
+// otherwise defaultVal if the input is blank
+func getUserInputText(key, prompt, defaultVal string) string {
+	t, answered := getInitAnswer(key, prompt)
+	if !answered {
+		t = getUserInput(prompt)
+	}
 	if t == "" {
 		return defaultVal
 	}
 	return t
 }
 
-// Get user bool (y/n) input from stdin otherwise defaultVal if the input is
-// blank
-func getUserInputYN(prompt string, defaultVal bool) bool {
+// Get user bool (y/n) input for answer key from the init answers or stdin
+// otherwise defaultVal if the input is blank.  A blank answer key always
+// reads from stdin
+func getUserInputYN(key, prompt string, defaultVal bool) bool {
 	for {
-		b := strings.ToLower(getUserInput(prompt))
-		switch {
-		case b == "y":
+		b, answered := getInitAnswer(key, prompt)
+		if !answered {
+			b = getUserInput(prompt)
+		}
+		switch strings.ToLower(b) {
+		case "y", "yes", "true":
 			return true
-		case b == "n":
+		case "n", "no", "false":
 			return false
-		case b == "":
+		case "":
 			return defaultVal
-		default:
-			fmt.Println("Value must be \"Y\" or \"N\".  Try again.")
 		}
+		if answered {
+			addInitAnswerError(key, prompt, "value must be \"y\" or \"n\"")
+			return defaultVal
+		}
+		fmt.Println("Value must be \"Y\" or \"N\".  Try again.")
 	}
 }
 
-// Get user int input from stdin between min and max that is not in
-// forbiddenValues otherwise defaultVal if input is blank
-func getUserInputInt(prompt string, min, max, defaultVal int,
+// Get user int input for answer key from the init answers or stdin between
+// min and max that is not in forbiddenValues otherwise defaultVal if input
+// is blank
+func getUserInputInt(key, prompt string, min, max, defaultVal int,
 	forbiddenValues []int) int {
 	for {
-		iStr := getUserInput(prompt)
+		iStr, answered := getInitAnswer(key, prompt)
+		if !answered {
+			iStr = getUserInput(prompt)
+		}
 		if iStr == "" {
 			iStr = strconv.Itoa(defaultVal)
 		}
 		i, err := strconv.Atoi(iStr)
+		errMsg := ""
 		if err == nil && i >= min && i <= max {
 			forbiddenValue := -1
 			for _, fi := range forbiddenValues {
@@ -74,10 +265,36 @@ func getUserInputInt(prompt string, min, max, defaultVal int,
 			if forbiddenValue < 0 {
 				return i
 			}
-			fmt.Printf("Value cannot be \"%d\".  Try again.\n", forbiddenValue)
+			errMsg = fmt.Sprintf("Value cannot be \"%d\".", forbiddenValue)
 		} else {
-			fmt.Printf("Value must be an integer between (and including) \"%d\" and \"%d\".  Try again.\n", min, max)
+			errMsg = fmt.Sprintf("Value must be an integer between (and including) \"%d\" and \"%d\".", min, max)
 		}
+		if answered {
+			addInitAnswerError(key, prompt, strings.ToLower(errMsg[:1])+
+				strings.TrimSuffix(errMsg[1:], "."))
+			return defaultVal
+		}
+		fmt.Println(errMsg + "  Try again.")
+	}
+}
+
+// Get user input for answer key from the init answers or stdin that is one
+// of choices otherwise defaultVal if input is blank
+func getUserInputChoice(key, prompt string, choices []string,
+	defaultVal string) string {
+	for {
+		choice := strings.ToLower(getUserInputText(key, prompt, defaultVal))
+		if stringInSlice(choice, choices) {
+			return choice
+		}
+		if _, answered := initAnswers[key]; answered ||
+			initUseDefaults || initNonInteractive {
+			addInitAnswerError(key, prompt, "value must be one of "+
+				strings.Join(choices, ", "))
+			return defaultVal
+		}
+		fmt.Printf("Value must be one of %s.  Try again.\n",
+			strings.Join(choices, ", "))
 	}
 }
 
@@ -85,44 +302,81 @@ func getUserInputInt(prompt string, min, max, defaultVal int,
 // prompts
 func initConfigData() {
 	configData = Config{
-		BergelmirVersion: VERSION,
+		BergelmirVersion:       VERSION,
+		ShutdownTimeoutSeconds: SHUTDOWN_DEFAULT_TIMEOUT,
 		Tor: ConfigTor{
 			ControlAuthCookiePath:       "tor/control_auth_cookie",
 			ControlPortFilePath:         "tor/control_port",
 			HiddenServicePrivateKeyPath: "tor/hs_ed25519_secret_key",
 			TorrcPath:                   "tor/torrc",
 		},
+		Encryption: ConfigEncryption{
+			PassphraseEnv: DEFAULT_PASSPHRASE_ENV,
+		},
+		Robots: ConfigRobots{
+			Rules: []ConfigRobotsRule{{UserAgents: []string{"*"}}},
+		},
+		Files: ConfigFiles{
+			Symlinks:      SYMLINKS_WITHIN_ROOT,
+			DenyPatterns:  defaultDenyPatterns,
+			AllowPatterns: defaultAllowPatterns,
+		},
 		Gemini: ConfigGemini{
 			DataPath:          "gemini/",
 			ListeningLocation: "127.0.0.1:1965",
 			TLS: ConfigGeminiTLS{
 				CertPath: "tls/cert.pem",
 				KeyPath:  "tls/cert.key",
+				KeyType:  TLS_KEY_TYPE_ED25519,
 			},
 			Tor: ConfigGeminiTor{
 				VirtualPort: GEMINI_DEFAULT_PORT,
 			},
 		},
 		HTTP: ConfigHTTP{
-			DataPath:          "http/",
-			LayoutHTMLPath:    "http/layout.html",
-			ListeningLocation: "127.0.0.1:8080",
+			DataPath:           "http/",
+			LayoutHTMLPath:     "http/layout.html",
+			LayoutPartialsPath: "http/partials/",
+			SitemapEnabled:     true,
+			ListeningLocation:  "127.0.0.1:8080",
+			CacheControl:       defaultHTTPCacheControl,
+			SecurityHeaders:    defaultHTTPSecurityHeaders,
+			Compression: ConfigHTTPCompression{
+				Enabled:      true,
+				MinSizeBytes: COMPRESSION_DEFAULT_MIN_SIZE,
+				ContentTypes: defaultCompressedContentTypes,
+			},
+			Links: ConfigHTTPLinks{
+				RewriteCapsuleLinks: true,
+				RewriteOnionLinks:   true,
+			},
 			Tor: ConfigHTTPTor{
 				VirtualPort: HTTP_DEFAULT_PORT,
 			},
+			HTTPS: ConfigHTTPHTTPS{
+				ListeningLocation: "0.0.0.0:443",
+				ACME: ConfigHTTPHTTPSACME{
+					DirectoryURL: autocert.DefaultACMEDirectory,
+					Challenge:    ACME_CHALLENGE_TLS_ALPN_01,
+					CachePath:    "tls/acme/",
+				},
+			},
 		},
 	}
 }
 
 // Ask user for user input to populate configData and save configData to
 // config.yaml
-func initBergelmirProject() {
-	if fileExists(CONFIG_FILE_PATH) {
-		if !getUserInputYN(CONFIG_FILE_PATH+
+func initBergelmirProject() int {
+	if fileExists(configFilePath) {
+		if !getUserInputYN("overwrite", configFilePath+
 			" already exists.\nCreate new config file anyways?\n"+
-			"This will overwrite "+CONFIG_FILE_PATH+" [y/N]: ", false) {
+			"This will overwrite "+configFilePath+" [y/N]: ", false) {
+			if len(initAnswerErrors) > 0 {
+				return printInitAnswerErrors()
+			}
 			fmt.Println("Exiting...")
-			os.Exit(0)
+			return EXIT_SUCCESS
 		}
 		fmt.Println()
 	}
@@ -130,14 +384,14 @@ func initBergelmirProject() {
 	//generateConfigFile()
 	fmt.Println("Initializing Bergelmir Project")
 	// Ask if tor should be enabled
-	configData.Tor.Enabled = getUserInputYN(
+	configData.Tor.Enabled = getUserInputYN("tor-enabled",
 		"Enable Tor \".onion\" address? [y/N]: ", false)
 	// Ask which port the gemini capsule is listening on
-	geminiPort := getUserInputInt("Gemini capsule listening port [ 1965 ]: ",
+	geminiPort := getUserInputInt("gemini-port", "Gemini capsule listening port [ 1965 ]: ",
 		1, 65535, GEMINI_DEFAULT_PORT, []int{})
 	configData.Gemini.ListeningLocation = strconv.Itoa(geminiPort)
 	// Ask if gemini capsule is listening on localhost
-	if getUserInputYN(
+	if getUserInputYN("gemini-localhost",
 		"Limit Gemini capsule reachability to localhost [y/N]: ", false) {
 		configData.Gemini.ListeningLocation = "127.0.0.1:" +
 			configData.Gemini.ListeningLocation
@@ -147,34 +401,46 @@ func initBergelmirProject() {
 	}
 	// Ask for domain names
 	configData.Gemini.DomainNames = strings.Fields(
-		getUserInput("Domain names of Gemini capsule (space seperated):\n"))
+		getUserInputText("gemini-domain-names",
+			"Domain names of Gemini capsule (space seperated):\n", ""))
 	// Ask for gemini capsule file path
-	configData.Gemini.DataPath = getUserInputText(
+	configData.Gemini.DataPath = getUserInputText("gemini-data-path",
 		"Path for Gemini capsule files [ gemini/ ]: ", "gemini/")
+	initTLS()
+	// Ask if private keys should be encrypted at rest
+	configData.Encryption.Enabled = getUserInputYN("encrypt-keys",
+		"Encrypt TLS and Tor private keys with a passphrase? [y/N]: ", false)
+	if configData.Encryption.Enabled {
+		configData.Encryption.PassphraseFilePath = getUserInputText(
+			"passphrase-file", "Passphrase file path (blank to use $"+
+				DEFAULT_PASSPHRASE_ENV+" or a prompt at startup): ", "")
+	}
 	if configData.Tor.Enabled {
 		// Ask which port the tor hidden service for the gemini capsule is
 		// listening on
-		configData.Gemini.Tor.VirtualPort = getUserInputInt(
+		configData.Gemini.Tor.VirtualPort = getUserInputInt("tor-gemini-port",
 			"Tor listening port for Gemini capsule [ 1965 ]: ",
 			1, 65535, GEMINI_DEFAULT_PORT, []int{})
+		initTorBridges()
 	}
 	// Ask if RSS feed should be enabled
-	configData.RSS.Enabled = getUserInputYN(
+	configData.RSS.Enabled = getUserInputYN("rss-enabled",
 		"Enable RSS feed at /rss and /feed URLs? [Y/n]", true)
 	if configData.RSS.Enabled {
-		configData.RSS.FeedSourceGeminiPath = getUserInputText(
+		configData.RSS.FeedSourceGeminiPath = getUserInputText("rss-feed-source",
 			"Gemini source path for RSS feed [ /blog ]: ", "blog")
 	}
 	// Ask if http server should be enabled
-	configData.HTTP.Enabled = getUserInputYN(
+	configData.HTTP.Enabled = getUserInputYN("http-enabled",
 		"Enable HTTP server? [Y/n]: ", true)
 	if configData.HTTP.Enabled {
 		// Ask which port the http server is listening on
-		configData.HTTP.ListeningLocation = strconv.Itoa(
-			getUserInputInt("HTTP server listening port [ 8080 ]: ",
-				1, 65535, 8080, []int{geminiPort}))
+		httpPort := getUserInputInt("http-port",
+			"HTTP server listening port [ 8080 ]: ", 1, 65535, 8080,
+			[]int{geminiPort})
+		configData.HTTP.ListeningLocation = strconv.Itoa(httpPort)
 		// Ask if http server is listening on localhost
-		if getUserInputYN(
+		if getUserInputYN("http-localhost",
 			"Limit HTTP server reachability to localhost [y/N]: ", false) {
 			configData.HTTP.ListeningLocation = "127.0.0.1:" +
 				configData.HTTP.ListeningLocation
@@ -183,34 +449,32 @@ func initBergelmirProject() {
 				configData.HTTP.ListeningLocation
 		}
 		// Ask for http server file path
-		configData.HTTP.DataPath = getUserInputText(
+		configData.HTTP.DataPath = getUserInputText("http-data-path",
 			"Path for HTTP server files [ http/ ]: ", "http/")
 		// Set default HTML layout file path
 		configData.HTTP.LayoutHTMLPath = strings.TrimSuffix(
 			configData.HTTP.DataPath, "/") + "/layout.html"
+		configData.HTTP.LayoutPartialsPath = strings.TrimSuffix(
+			configData.HTTP.DataPath, "/") + "/partials/"
 		// Ask for default html page title
-		configData.HTTP.DefaultPageTitle = getUserInput(
-			"Default HTML page title: ")
+		configData.HTTP.DefaultPageTitle = getUserInputText("http-page-title",
+			"Default HTML page title: ", "")
 		if configData.Tor.Enabled {
 			// Ask which port the tor hidden service for the http server is
 			// listening on
-			configData.HTTP.Tor.VirtualPort = getUserInputInt(
+			configData.HTTP.Tor.VirtualPort = getUserInputInt("tor-http-port",
 				"Tor listening port for HTTP Server [ 80 ]: ",
 				1, 65535, HTTP_DEFAULT_PORT, []int{configData.Gemini.Tor.VirtualPort})
 		}
+		initHTTPS(geminiPort, httpPort)
 	}
-
-	// Create torrc path directory
-	createFileDirectory(configData.Tor.TorrcPath)
-	if !fileExists(configData.Tor.TorrcPath) {
-		// Write default torrc file to torrc path if it does not already exist
-		torrcData := bytes.ReplaceAll(defaultTorrcFileContent,
-			[]byte("%COOKIE_AUTH_FILE%"),
-			[]byte(configData.Tor.ControlAuthCookiePath))
-		torrcData = bytes.ReplaceAll(torrcData, []byte("%CONTROL_PORT_FILE%"),
-			[]byte(configData.Tor.ControlPortFilePath))
-		writeFile(configData.Tor.TorrcPath, torrcData)
+	if len(initAnswerErrors) > 0 {
+		// Nothing is written if any answer is missing or invalid
+		return printInitAnswerErrors()
 	}
+
+	// Write torrc file generated from configData to torrc path
+	writeTorrcFile()
 	// Create tor control port path directory
 	createFileDirectory(configData.Tor.ControlPortFilePath)
 	// Create tor control auth cookie path directory
@@ -237,4 +501,167 @@ func initBergelmirProject() {
 	// Create TLS key path directory
 	createFileDirectory(configData.Gemini.TLS.KeyPath)
 	generateConfigFile()
+	return EXIT_SUCCESS
+}
+
+// Print the missing and invalid init answers.  Returns the exit code
+func printInitAnswerErrors() int {
+	logError("Unable to initialize Bergelmir project:")
+	for _, answerErr := range initAnswerErrors {
+		logError("  %s", answerErr)
+	}
+	logError("Pass the answers as flags or in an --answers file, or use " +
+		"--defaults to use the default values")
+	return EXIT_USAGE
+}
+
+// Ask user for Tor bridge lines and the pluggable transport binaries those
+// bridge lines need
+func initTorBridges() {
+	configData.Tor.UseBridges = getUserInputYN("tor-use-bridges",
+		"Connect to Tor using bridges (for networks that block Tor)? [y/N]: ",
+		false)
+	if !configData.Tor.UseBridges {
+		return
+	}
+	transportPaths := map[string]string{}
+	transportOrder := []string{}
+	bridges := []string{}
+	if answer, answered := getInitAnswer("tor-bridges", "Bridge lines"); answered {
+		bridges = strings.Split(answer, "\n")
+		if strings.TrimSpace(answer) == "" {
+			addInitAnswerError("tor-bridges", "Bridge lines",
+				"at least one bridge line is required")
+		}
+	} else {
+		fmt.Println("Enter bridge lines (for example from " +
+			"https://bridges.torproject.org/), one per line.  " +
+			"Leave blank to finish.")
+		for {
+			bridge := strings.TrimSpace(getUserInput("Bridge line: "))
+			if bridge == "" {
+				if len(bridges) == 0 {
+					fmt.Println("At least one bridge line is required.  Try again.")
+					continue
+				}
+				break
+			}
+			bridges = append(bridges, bridge)
+		}
+	}
+	for _, bridge := range bridges {
+		bridge = strings.TrimPrefix(strings.TrimSpace(bridge), "Bridge ")
+		if bridge == "" {
+			continue
+		}
+		configData.Tor.Bridges = append(configData.Tor.Bridges, bridge)
+		transport := bridgeLineTransport(bridge)
+		if transport == "" {
+			continue
+		}
+		if _, ok := transportPaths[transport]; !ok {
+			transportOrder = append(transportOrder, transport)
+			transportPaths[transport] = ""
+		}
+	}
+	// Ask for the binary of each pluggable transport the bridge lines use
+	for _, transport := range transportOrder {
+		defaultPath := defaultPluggableTransportPath(transport)
+		prompt := fmt.Sprintf("Path to %s pluggable transport binary: ",
+			transport)
+		if defaultPath != "" {
+			prompt = fmt.Sprintf(
+				"Path to %s pluggable transport binary [ %s ]: ", transport,
+				defaultPath)
+		}
+		key := "tor-transport-" + transport
+		if answer, answered := getInitAnswer(key, prompt); answered {
+			transportPaths[transport] = answer
+			if answer == "" {
+				transportPaths[transport] = defaultPath
+			}
+			// There is no one left to ask without a default path
+			if transportPaths[transport] == "" {
+				addInitAnswerError(key, prompt,
+					"no default path, an answer is required")
+			}
+			continue
+		}
+		for transportPaths[transport] == "" {
+			transportPaths[transport] = getUserInputText("", prompt,
+				defaultPath)
+		}
+	}
+	// Transports that share a binary share a ClientTransportPlugin line
+	for _, transport := range transportOrder {
+		path := transportPaths[transport]
+		shared := false
+		for i := range configData.Tor.PluggableTransports {
+			if configData.Tor.PluggableTransports[i].Path == path {
+				configData.Tor.PluggableTransports[i].Transports = append(
+					configData.Tor.PluggableTransports[i].Transports, transport)
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			configData.Tor.PluggableTransports = append(
+				configData.Tor.PluggableTransports, ConfigTorTransport{
+					Transports: []string{transport},
+					Path:       path,
+				})
+		}
+	}
+}
+
+// Ask user if the HTTP server should also listen with HTTPS using ACME
+// certificates
+func initHTTPS(geminiPort, httpPort int) {
+	configData.HTTP.HTTPS.Enabled = getUserInputYN("https-enabled",
+		"Enable HTTPS server with ACME (Let's Encrypt) certificates? [y/N]: ",
+		false)
+	if !configData.HTTP.HTTPS.Enabled {
+		return
+	}
+	// Ask which port the https server is listening on
+	configData.HTTP.HTTPS.ListeningLocation = "0.0.0.0:" + strconv.Itoa(
+		getUserInputInt("https-port", "HTTPS server listening port [ 443 ]: ",
+			1, 65535, HTTPS_DEFAULT_PORT, []int{geminiPort, httpPort}))
+	// Ask for ACME certificate domain names
+	configData.HTTP.HTTPS.ACME.DomainNames = strings.Fields(
+		getUserInputText("acme-domain-names", "Domain names for ACME "+
+			"certificates (space seperated, blank to use Gemini capsule "+
+			"domain names):\n", ""))
+	configData.HTTP.HTTPS.ACME.DirectoryURL = getUserInputText(
+		"acme-directory-url", "ACME directory URL [ "+autocert.DefaultACMEDirectory+" ]: ",
+		autocert.DefaultACMEDirectory)
+	configData.HTTP.HTTPS.ACME.Challenge = getUserInputChoice(
+		"acme-challenge", "ACME challenge type (tls-alpn-01 or http-01) "+
+			"[ tls-alpn-01 ]: ", []string{ACME_CHALLENGE_TLS_ALPN_01,
+			ACME_CHALLENGE_HTTP_01}, ACME_CHALLENGE_TLS_ALPN_01)
+	configData.HTTP.HTTPS.ACME.Email = getUserInputText("acme-email",
+		"Contact email for ACME account (optional): ", "")
+	configData.HTTP.HTTPS.ACME.AcceptTermsOfService = getUserInputYN(
+		"acme-accept-tos", "Accept the terms of service of the ACME CA? [y/N]: ", false)
+	configData.HTTP.HTTPS.RedirectHTTP = getUserInputYN(
+		"https-redirect-http", "Redirect HTTP requests for the ACME domain names to HTTPS? [y/N]: ",
+		false)
+}
+
+// Ask user for the TLS key type and the self-signed TLS certificate subject
+// and validity period
+func initTLS() {
+	configData.Gemini.TLS.KeyType = getUserInputChoice("tls-key-type",
+		"TLS key type ("+strings.Join(tlsKeyTypes, ", ")+") [ ed25519 ]: ",
+		tlsKeyTypes, TLS_KEY_TYPE_ED25519)
+	defaultCommonName := ""
+	if len(configData.Gemini.DomainNames) > 0 {
+		defaultCommonName = configData.Gemini.DomainNames[0]
+	}
+	configData.Gemini.TLS.CommonName = getUserInputText("tls-common-name",
+		"TLS certificate subject common name [ "+defaultCommonName+" ]: ",
+		defaultCommonName)
+	configData.Gemini.TLS.ValidityDays = getUserInputInt("tls-validity-days",
+		"TLS certificate validity in days (0 for valid until 2200) [ 0 ]: ",
+		0, 365000, 0, []int{})
 }
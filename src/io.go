@@ -24,3 +24,24 @@ func writeFile(filePath string, content []byte) {
 	handleErr(os.WriteFile(filePath, content, 0600),
 		fmt.Sprintf("Unable to write content to file %s", filePath))
 }
+
+// Write content to a temporary file next to filePath and rename it to
+// filePath so filePath is never left partially written
+func writeFileAtomic(filePath string, content []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(filePath),
+		"."+filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filePath)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Run `bergelmir keys <subcommand>` and return the exit code
+func runKeysCommand(subcommand string) int {
+	switch subcommand {
+	case "encrypt":
+		return encryptPrivateKeyFiles()
+	case "decrypt":
+		return decryptPrivateKeyFiles()
+	default:
+		fmt.Printf("Usage: %s keys <subcommand>\n\n", bergelmirCmd)
+		fmt.Println("Subcommands:")
+		fmt.Println("  encrypt  Encrypt the TLS and tor hidden service " +
+			"private keys with the encryption passphrase")
+		fmt.Println("  decrypt  Decrypt the TLS and tor hidden service " +
+			"private keys")
+		if subcommand != "help" {
+			return EXIT_USAGE
+		}
+		return EXIT_SUCCESS
+	}
+}
+
+// Get the paths of the private key files that can be encrypted
+func getPrivateKeyFilePaths() []string {
+	paths := []string{}
+	for _, path := range []string{configData.Gemini.TLS.KeyPath,
+		configData.Tor.HiddenServicePrivateKeyPath} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Encrypt the private key files that aren't encrypted yet.  Returns the
+// exit code
+func encryptPrivateKeyFiles() int {
+	passphrase, err := getEncryptionPassphrase()
+	if err == nil && configData.Encryption.PassphraseFilePath == "" &&
+		os.Getenv(getPassphraseEnv()) == "" {
+		// Passphrase was typed, so make sure it was typed correctly
+		var confirmation []byte
+		confirmation, err = promptPassphrase("Repeat encryption passphrase: ")
+		if err == nil && string(confirmation) != string(passphrase) {
+			err = fmt.Errorf("passphrases do not match")
+		}
+	}
+	if err != nil {
+		logError("Unable to get encryption passphrase: %s", err)
+		return EXIT_FAILURE
+	}
+	exitCode := EXIT_SUCCESS
+	for _, path := range getPrivateKeyFilePaths() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			logWarn("- Skipping %s: %s", path, err)
+			continue
+		}
+		if isEncryptedData(content) {
+			logInfo("- Skipping %s: already encrypted", path)
+			continue
+		}
+		encrypted, err := encryptData(content, passphrase)
+		if err == nil {
+			err = writeFileAtomic(path, encrypted)
+		}
+		if err != nil {
+			logError("- Unable to encrypt %s: %s", path, err)
+			exitCode = EXIT_FAILURE
+			continue
+		}
+		logInfo("- Encrypted %s", path)
+	}
+	if !configData.Encryption.Enabled {
+		logInfo("Set encryption.enabled to true in the config file so " +
+			"newly generated private keys are also encrypted")
+	}
+	return exitCode
+}
+
+// Decrypt the private key files that are encrypted.  Returns the exit code
+func decryptPrivateKeyFiles() int {
+	exitCode := EXIT_SUCCESS
+	for _, path := range getPrivateKeyFilePaths() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			logWarn("- Skipping %s: %s", path, err)
+			continue
+		}
+		if !isEncryptedData(content) {
+			logInfo("- Skipping %s: not encrypted", path)
+			continue
+		}
+		content, err = readFileDecrypted(path)
+		if err == nil {
+			err = writeFileAtomic(path, content)
+		}
+		if err != nil {
+			logError("- Unable to decrypt %s: %s", path, err)
+			exitCode = EXIT_FAILURE
+			continue
+		}
+		logInfo("- Decrypted %s", path)
+	}
+	if configData.Encryption.Enabled {
+		logInfo("Set encryption.enabled to false in the config file so " +
+			"newly generated private keys are also not encrypted")
+	}
+	return exitCode
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Placeholders of layouts from before html/template layouts
+	LEGACY_TITLE_PLACEHOLDER   = "%TITLE%"
+	LEGACY_CONTENT_PLACEHOLDER = "%GEMINI_CONTENT%"
+)
+
+// Variables of the HTML layout template
+type htmlLayoutData struct {
+	Title        string
+	Description  string
+	CanonicalURL string
+	OnionURL     string
+	RSSURL       string
+	LastModified time.Time
+	Breadcrumbs  []htmlBreadcrumb
+	// TableOfContents lists the headings after the page title, if the page
+	// has at least TABLE_OF_CONTENTS_MIN_HEADINGS of them
+	TableOfContents []htmlTOCEntry
+	// PreviousPost and NextPost are the older and newer posts on the
+	// gemlog page, or nil
+	PreviousPost *htmlLink
+	NextPost     *htmlLink
+	FrontMatter  map[string]string
+	Content      template.HTML
+}
+
+// A page on the way from the home page to the current page.  The last
+// breadcrumb is the current page
+type htmlBreadcrumb struct {
+	Title   string
+	URL     string
+	Current bool
+}
+
+// A heading in the table of contents, linking to its id
+type htmlTOCEntry struct {
+	Level int
+	Title string
+	ID    string
+}
+
+// A link to another page
+type htmlLink struct {
+	Title string
+	URL   string
+}
+
+var (
+	// Parsed HTML layout with its partials, reparsed when the files change
+	htmlLayout          *template.Template
+	htmlLayoutSignature string
+	htmlLayoutLock      sync.Mutex
+)
+
+// Get the paths of the HTML layout and its partials, the *.html files in
+// the layout partials path
+func htmlLayoutFiles(config Config) []string {
+	files := []string{config.HTTP.LayoutHTMLPath}
+	if config.HTTP.LayoutPartialsPath != "" {
+		partials, _ := filepath.Glob(filepath.Join(
+			config.HTTP.LayoutPartialsPath, "*.html"))
+		sort.Strings(partials)
+		files = append(files, partials...)
+	}
+	return files
+}
+
+// Get the file infos of the HTML layout and its partials
+func htmlLayoutFileInfos(config Config) []fs.FileInfo {
+	var infos []fs.FileInfo
+	for _, file := range htmlLayoutFiles(config) {
+		if info, err := os.Stat(file); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// Parse the HTML layout of config and its partials.  Each partial is a
+// named template called by its file name without extension, such as
+// {{template "header" .}}.  Layouts with the %TITLE% and %GEMINI_CONTENT%
+// placeholders still work
+func parseHTMLLayout(config Config) (*template.Template, error) {
+	files := htmlLayoutFiles(config)
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		return nil, err
+	}
+	layout := strings.ReplaceAll(string(content), LEGACY_TITLE_PLACEHOLDER,
+		"{{.Title}}")
+	layout = strings.ReplaceAll(layout, LEGACY_CONTENT_PLACEHOLDER,
+		"{{.Content}}")
+	t, err := template.New(filepath.Base(files[0])).Parse(layout)
+	if err != nil {
+		return nil, err
+	}
+	// Partials are parsed after the layout, so they replace the defaults of
+	// {{block}} actions in the layout
+	for _, file := range files[1:] {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		if _, err := t.New(name).Parse(string(content)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Get the parsed HTML layout, parsing it again if the layout or partial
+// files changed
+func getHTMLLayout() (*template.Template, error) {
+	config := getConfig()
+	var signature strings.Builder
+	for _, file := range htmlLayoutFiles(config) {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&signature, "%s|%d|%d|", file, info.ModTime().UnixNano(),
+			info.Size())
+	}
+	htmlLayoutLock.Lock()
+	defer htmlLayoutLock.Unlock()
+	if htmlLayout != nil && htmlLayoutSignature == signature.String() {
+		return htmlLayout, nil
+	}
+	t, err := parseHTMLLayout(config)
+	if err != nil {
+		return nil, err
+	}
+	htmlLayout, htmlLayoutSignature = t, signature.String()
+	return htmlLayout, nil
+}
+
+// Get the base URL of the HTTP mirror, http.base_url or else the scheme and
+// host of the request
+func getHTTPBaseURL(requestURL string) string {
+	if baseURL := getConfig().HTTP.BaseURL; baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	return requestURL
+}
+
+// Get the title of the Gemtext page at URL path urlPath from its front
+// matter or its first level 1 heading
+func getGemtextPageTitle(urlPath string) (title string, exists bool) {
+	frontMatter, content, exists := getGemtextPage(urlPath)
+	if frontMatter["title"] != "" {
+		return frontMatter["title"], exists
+	}
+	return gemtextTitle(string(content)), exists
+}
+
+// Get the breadcrumbs of URL path urlPath, the home page, the pages of the
+// parent directories, <dir>.gmi or <dir>/index.gmi, and the page itself
+func getBreadcrumbs(urlPath string) []htmlBreadcrumb {
+	homeTitle, _ := getGemtextPageTitle("/index")
+	if homeTitle == "" {
+		homeTitle = "Home"
+	}
+	breadcrumbs := []htmlBreadcrumb{{Title: homeTitle, URL: "/"}}
+	if urlPath == "/index" {
+		return breadcrumbs
+	}
+	elements := strings.Split(strings.Trim(urlPath, "/"), "/")
+	for i, element := range elements {
+		crumbURL := "/" + path.Join(elements[:i+1]...)
+		title, exists := getGemtextPageTitle(crumbURL)
+		// The index page of the directory of urlPath is urlPath itself
+		if !exists && crumbURL != urlPath && crumbURL+"/index" != urlPath {
+			crumbURL += "/index"
+			title, exists = getGemtextPageTitle(crumbURL)
+		}
+		if !exists && crumbURL != urlPath {
+			continue
+		}
+		if title == "" {
+			title = element
+		}
+		breadcrumbs = append(breadcrumbs, htmlBreadcrumb{Title: title,
+			URL: crumbURL})
+	}
+	breadcrumbs[len(breadcrumbs)-1].Current = true
+	return breadcrumbs
+}
+
+// Render the Gemtext page at URL path urlPath into the HTML layout.
+// baseURL is the scheme and host of the canonical and RSS URLs unless
+// http.base_url is set.  exists is false if there is no such page
+func renderHTMLPage(urlPath, baseURL string) (htmlPage []byte, exists bool,
+	err error) {
+	frontMatter, gmiContent, exists := getGemtextPage(urlPath)
+	if !exists {
+		return
+	}
+	layout, err := getHTMLLayout()
+	if err != nil {
+		return nil, true, fmt.Errorf("unable to parse HTML layout: %w", err)
+	}
+	config := getConfig()
+	content, pageTitle := translateGemtextToHTML(string(gmiContent))
+	data := htmlLayoutData{
+		Title:       pageTitle,
+		Description: gemtextDescription(string(gmiContent)),
+		FrontMatter: frontMatter,
+		Content:     template.HTML(content),
+	}
+	if frontMatter["title"] != "" {
+		data.Title = frontMatter["title"]
+	}
+	if frontMatter["description"] != "" {
+		data.Description = frontMatter["description"]
+	}
+	pagePath := urlPath
+	if pagePath == "/index" {
+		pagePath = "/"
+	}
+	baseURL = getHTTPBaseURL(baseURL)
+	data.CanonicalURL = baseURL + pagePath
+	data.OnionURL = onionMirrorURL(&url.URL{Path: pagePath})
+	if config.RSS.Enabled {
+		data.RSSURL = baseURL + "/feed"
+	}
+	if info, ok := statGemtextFile(urlPath); ok {
+		data.LastModified = info.ModTime()
+	}
+	// Page links point to .html pages, which also work in static builds
+	for _, breadcrumb := range getBreadcrumbs(urlPath) {
+		if breadcrumb.URL != "/" {
+			breadcrumb.URL = htmlPagePath(breadcrumb.URL + ".gmi")
+		}
+		data.Breadcrumbs = append(data.Breadcrumbs, breadcrumb)
+	}
+	for _, entry := range getTableOfContents(string(gmiContent)) {
+		data.TableOfContents = append(data.TableOfContents,
+			htmlTOCEntry{entry.level, entry.text, entry.id})
+	}
+	previous, next := getAdjacentPosts(urlPath)
+	if previous != nil {
+		data.PreviousPost = &htmlLink{previous.title,
+			htmlPagePath(previous.urlPath + ".gmi")}
+	}
+	if next != nil {
+		data.NextPost = &htmlLink{next.title,
+			htmlPagePath(next.urlPath + ".gmi")}
+	}
+	var page bytes.Buffer
+	if err := layout.Execute(&page, data); err != nil {
+		return nil, true, fmt.Errorf("unable to render HTML layout: %w", err)
+	}
+	return page.Bytes(), true, nil
+}
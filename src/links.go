@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Get the HTML mirror path of a Gemtext page path, replacing the .gmi or
+// .gemini extension with .html, which works both on the HTTP mirror and in
+// static builds
+func htmlPagePath(pagePath string) string {
+	extension := path.Ext(pagePath)
+	if extension == ".gmi" || extension == ".gemini" {
+		return strings.TrimSuffix(pagePath, extension) + ".html"
+	}
+	return pagePath
+}
+
+// Rewrite the target of a Gemtext link for the HTML mirror by the
+// http.links config.  Relative links to Gemtext pages and gemini:// links
+// to the capsule itself point to the HTTP mirror, gemini:// links to the
+// capsule onion address point to the onion HTTP mirror, and other gemini://
+// links go through the Gemini web proxy prefix if set.  Returns the link
+// unchanged and rewritten false otherwise
+func rewriteGemtextLink(link string) (href string, rewritten bool) {
+	config := getConfig()
+	links := config.HTTP.Links
+	u, err := url.Parse(link)
+	if err != nil {
+		return link, false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		if !links.RewriteCapsuleLinks || htmlPagePath(u.Path) == u.Path {
+			return link, false
+		}
+		u.Path = htmlPagePath(u.Path)
+		return u.String(), true
+	}
+	if !strings.EqualFold(u.Scheme, "gemini") {
+		return link, false
+	}
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = strconv.Itoa(GEMINI_DEFAULT_PORT)
+	}
+	capsulePort, capsuleHost := getGeminiHostPortValid(host)
+	switch {
+	case capsuleHost && port == capsulePort && host == getTorAddress():
+		mirror := onionMirrorURL(&url.URL{Path: htmlPagePath(u.Path),
+			RawQuery: u.RawQuery, Fragment: u.Fragment})
+		if !links.RewriteOnionLinks || mirror == "" {
+			return link, false
+		}
+		return mirror, true
+	case capsuleHost && port == capsulePort:
+		if !links.RewriteCapsuleLinks {
+			return link, false
+		}
+		// Relative to the host, so readers stay on the mirror they use
+		mirror := &url.URL{Path: htmlPagePath(u.Path), RawQuery: u.RawQuery,
+			Fragment: u.Fragment}
+		if mirror.Path == "" {
+			mirror.Path = "/"
+		}
+		return mirror.String(), true
+	case links.GeminiProxyPrefix != "" && u.Host != "":
+		proxied := links.GeminiProxyPrefix + u.Host + u.EscapedPath()
+		if u.RawQuery != "" {
+			proxied += "?" + u.RawQuery
+		}
+		if u.Fragment != "" {
+			proxied += "#" + u.EscapedFragment()
+		}
+		return proxied, true
+	}
+	return link, false
+}
+
+// Get the URL of u on the onion HTTP mirror.  Returns "" if the HTTP mirror
+// has no onion address
+func onionMirrorURL(u *url.URL) string {
+	config := getConfig()
+	address := getTorAddress()
+	if address == "" || !config.HTTP.Enabled {
+		return ""
+	}
+	mirror := *u
+	mirror.Scheme, mirror.Host = "http", address
+	if config.HTTP.Tor.VirtualPort != HTTP_DEFAULT_PORT {
+		mirror.Host += ":" + strconv.Itoa(config.HTTP.Tor.VirtualPort)
+	}
+	if mirror.Path == "" {
+		mirror.Path = "/"
+	}
+	return mirror.String()
+}
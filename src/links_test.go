@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteGemtextLink(t *testing.T) {
+	config := Config{}
+	config.Gemini.ListeningLocation = "0.0.0.0:1965"
+	config.HTTP.Links = ConfigHTTPLinks{
+		RewriteCapsuleLinks: true,
+		GeminiProxyPrefix:   "https://proxy.example/gemini/",
+	}
+	setConfig(config)
+	geminiHostList = []string{"capsule.example"}
+	defer func() {
+		setConfig(Config{})
+		geminiHostList = []string{}
+	}()
+	tests := []struct {
+		link      string
+		href      string
+		rewritten bool
+	}{
+		{"page.gmi", "page.html", true},
+		{"/dir/page.gemini?q=1#top", "/dir/page.html?q=1#top", true},
+		{"image.png", "image.png", false},
+		{"https://example.org/", "https://example.org/", false},
+		{"gemini://capsule.example/page.gmi", "/page.html", true},
+		{"gemini://capsule.example", "/", true},
+		{"gemini://capsule.example:1966/page.gmi",
+			"https://proxy.example/gemini/capsule.example:1966/page.gmi", true},
+		{"gemini://other.example/a%20b.gmi?x=y#z",
+			"https://proxy.example/gemini/other.example/a%20b.gmi?x=y#z", true},
+		{"GEMINI://other.example/", "https://proxy.example/gemini/other.example/",
+			true},
+		{"gemini:", "gemini:", false},
+		{"gemini:page.gmi", "gemini:page.gmi", false},
+		{"gemini:///page.gmi", "gemini:///page.gmi", false},
+		{"gemini://%zz", "gemini://%zz", false},
+	}
+	for _, test := range tests {
+		href, rewritten := rewriteGemtextLink(test.link)
+		if href != test.href || rewritten != test.rewritten {
+			t.Errorf("rewriteGemtextLink(%q) = %q, %v, want %q, %v", test.link,
+				href, rewritten, test.href, test.rewritten)
+		}
+	}
+}
+
+func TestRewriteGemtextOnionLink(t *testing.T) {
+	onion := "bergelmirexampleonionaddress.onion"
+	config := Config{}
+	config.Gemini.ListeningLocation = "0.0.0.0:1965"
+	config.Gemini.Tor.VirtualPort = 1965
+	config.HTTP.Enabled = true
+	config.HTTP.Tor.VirtualPort = 8080
+	config.HTTP.Links = ConfigHTTPLinks{
+		RewriteCapsuleLinks: true,
+		RewriteOnionLinks:   true,
+	}
+	setTorAddress(onion)
+	geminiHostList = []string{"capsule.example", onion}
+	defer func() {
+		setConfig(Config{})
+		setTorAddress("")
+		geminiHostList = []string{}
+	}()
+	tests := []struct {
+		configure func(config *Config)
+		link      string
+		href      string
+		rewritten bool
+	}{
+		{nil, "gemini://" + onion + "/page.gmi",
+			"http://" + onion + ":8080/page.html", true},
+		{nil, "gemini://" + onion, "http://" + onion + ":8080/", true},
+		{nil, "gemini://" + strings.ToUpper(onion) + "/dir/?q=1#top",
+			"http://" + onion + ":8080/dir/?q=1#top", true},
+		{nil, "gemini://" + onion + ":1966/page.gmi",
+			"gemini://" + onion + ":1966/page.gmi", false},
+		{nil, "gemini://capsule.example/page.gmi", "/page.html", true},
+		{func(config *Config) { config.HTTP.Tor.VirtualPort = HTTP_DEFAULT_PORT },
+			"gemini://" + onion + "/page.gmi",
+			"http://" + onion + "/page.html", true},
+		{func(config *Config) { config.HTTP.Links.RewriteOnionLinks = false },
+			"gemini://" + onion + "/page.gmi",
+			"gemini://" + onion + "/page.gmi", false},
+		{func(config *Config) { config.HTTP.Enabled = false },
+			"gemini://" + onion + "/page.gmi",
+			"gemini://" + onion + "/page.gmi", false},
+	}
+	for _, test := range tests {
+		testConfig := config
+		if test.configure != nil {
+			test.configure(&testConfig)
+		}
+		setConfig(testConfig)
+		href, rewritten := rewriteGemtextLink(test.link)
+		if href != test.href || rewritten != test.rewritten {
+			t.Errorf("rewriteGemtextLink(%q) = %q, %v, want %q, %v", test.link,
+				href, rewritten, test.href, test.rewritten)
+		}
+	}
+}
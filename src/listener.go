@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// A network listener of a server that can be moved to another listening
+// location without closing the open connections
+type serverListener struct {
+	lock     sync.Mutex
+	name     string
+	location string
+	listener net.Listener
+	// listen opens a listener at a listening location
+	listen func(location string) (net.Listener, error)
+	// serve accepts connections until the listener is closed
+	serve func(ln net.Listener)
+	// serving counts the serve calls that have not returned yet
+	serving sync.WaitGroup
+}
+
+var (
+	geminiListener = &serverListener{name: "Gemini capsule"}
+	httpListener   = &serverListener{name: "HTTP server"}
+	httpsListener  = &serverListener{name: "HTTPS server"}
+)
+
+// Open a network listener at a listening location, removing a stale unix
+// socket first
+func listenLocation(locationPath string) (net.Listener, error) {
+	network, location := parseLocation(locationPath)
+	if network == "unix" {
+		syscall.Unlink(location)
+	}
+	return net.Listen(network, location)
+}
+
+// Listen at location and start serving.  The current listener is only
+// closed once the new listener is open, unless location is the address of
+// the current listener
+func (s *serverListener) start(location string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ln, err := s.listen(location)
+	if errors.Is(err, syscall.EADDRINUSE) && s.listener != nil &&
+		location == s.location {
+		s.listener.Close()
+		s.listener = nil
+		ln, err = s.listen(location)
+	}
+	if err != nil {
+		return err
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.listener, s.location = ln, location
+	s.serving.Add(1)
+	go func() {
+		defer s.serving.Done()
+		s.serve(ln)
+	}()
+	return nil
+}
+
+// Stop accepting new connections and wait until no connection is being
+// accepted anymore.  Open connections are not closed
+func (s *serverListener) stop() {
+	s.lock.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	s.lock.Unlock()
+	s.serving.Wait()
+}
+
+// Check if the server is listening
+func (s *serverListener) running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.listener != nil
+}
+
+// Get the listening location of the server
+func (s *serverListener) getLocation() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.location
+}
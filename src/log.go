@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	LOG_LEVEL_DEBUG = iota
+	LOG_LEVEL_INFO
+	LOG_LEVEL_WARN
+	LOG_LEVEL_ERROR
+)
+
+var (
+	logLevel      = LOG_LEVEL_INFO
+	logLevelNames = map[string]int{
+		"debug": LOG_LEVEL_DEBUG,
+		"info":  LOG_LEVEL_INFO,
+		"warn":  LOG_LEVEL_WARN,
+		"error": LOG_LEVEL_ERROR,
+	}
+)
+
+// Set log level from its name (debug, info, warn or error)
+func setLogLevel(name string) error {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown log level %q, must be debug, info, warn "+
+			"or error", name)
+	}
+	logLevel = level
+	return nil
+}
+
+// Print status message to stdout if level is at least the log level.
+// Warnings and errors are printed to stderr
+func logMessage(level int, format string, a ...any) {
+	if level < logLevel {
+		return
+	}
+	if level >= LOG_LEVEL_WARN {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+		return
+	}
+	fmt.Printf(format+"\n", a...)
+}
+
+func logDebug(format string, a ...any) {
+	logMessage(LOG_LEVEL_DEBUG, format, a...)
+}
+
+func logInfo(format string, a ...any) {
+	logMessage(LOG_LEVEL_INFO, format, a...)
+}
+
+func logWarn(format string, a ...any) {
+	logMessage(LOG_LEVEL_WARN, format, a...)
+}
+
+func logError(format string, a ...any) {
+	logMessage(LOG_LEVEL_ERROR, format, a...)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+	"gopkg.in/yaml.v2"
+)
+
+// A config schema migration.  version is the bergelmir version the
+// migration upgrades config files to, and migrate changes the generic YAML
+// map of the config file in place
+type configMigration struct {
+	version     string
+	description string
+	migrate     func(config map[interface{}]interface{})
+}
+
+// Config migrations, oldest first.  Add a migration with a new version,
+// and bump VERSION to it, whenever a config field is added, renamed or
+// changes its meaning
+var configMigrations = []configMigration{
+	{
+		version:     "0.0.2",
+		description: "Add defaults for the HTTPS listener and ACME",
+		migrate: func(config map[interface{}]interface{}) {
+			setConfigDefault(config, "http.https.listening_location",
+				"0.0.0.0:"+strconv.Itoa(HTTPS_DEFAULT_PORT))
+			setConfigDefault(config, "http.https.acme.directory_url",
+				autocert.DefaultACMEDirectory)
+			setConfigDefault(config, "http.https.acme.challenge",
+				ACME_CHALLENGE_TLS_ALPN_01)
+			setConfigDefault(config, "http.https.acme.cache_path", "tls/acme/")
+		},
+	},
+	{
+		version:     "0.0.3",
+		description: "Add the default self-signed TLS key type",
+		migrate: func(config map[interface{}]interface{}) {
+			setConfigDefault(config, "gemini.tls.key_type", TLS_KEY_TYPE_ED25519)
+		},
+	},
+	{
+		version:     "0.0.4",
+		description: "Add the default private key passphrase variable",
+		migrate: func(config map[interface{}]interface{}) {
+			setConfigDefault(config, "encryption.passphrase_env",
+				DEFAULT_PASSPHRASE_ENV)
+		},
+	},
+	{
+		version:     "0.0.5",
+		description: "Add the default shutdown timeout",
+		migrate: func(config map[interface{}]interface{}) {
+			setConfigDefault(config, "shutdown_timeout_seconds",
+				SHUTDOWN_DEFAULT_TIMEOUT)
+		},
+	},
+	{
+		version:     "0.0.6",
+		description: "Enable HTTP compression",
+		migrate: func(config map[interface{}]interface{}) {
+			setConfigDefault(config, "http.compression.enabled", true)
+		},
+	},
+	{
+		version:     "0.0.7",
+		description: "Add the default symlink policy",
+		migrate: func(config map[interface{}]interface{}) {
+			setConfigDefault(config, "files.symlinks", SYMLINKS_WITHIN_ROOT)
+		},
+	},
+	{
+		version:     "0.0.8",
+		description: "Enable capsule and onion link rewriting",
+		migrate: func(config map[interface{}]interface{}) {
+			setConfigDefault(config, "http.links.rewrite_capsule_links", true)
+			setConfigDefault(config, "http.links.rewrite_onion_links", true)
+		},
+	},
+	{
+		version:     "0.0.9",
+		description: "Enable the sitemap",
+		migrate: func(config map[interface{}]interface{}) {
+			setConfigDefault(config, "http.sitemap_enabled", true)
+		},
+	},
+}
+
+// Upgrade the config file if it was written by an older bergelmir version.
+// The changes are shown and the old config file is kept as a backup.
+// Nothing is written if dryRun is set.  Returns the exit code and if the
+// config file needed a migration
+func migrateConfigFile(dryRun bool) (int, bool) {
+	content, err := os.ReadFile(configFilePath)
+	if err != nil {
+		logError("Unable to read config file %s: %s", configFilePath, err)
+		return EXIT_CONFIG, false
+	}
+	version, migrated, applied, err := migrateConfig(content)
+	if err != nil {
+		logError("Unable to migrate config file %s: %s", configFilePath, err)
+		return EXIT_CONFIG, false
+	}
+	if migrated == nil {
+		return EXIT_SUCCESS, false
+	}
+	from := "version " + version
+	if version == "" {
+		from, version = "no version", "unversioned"
+	}
+	logInfo("Migrating config file %s (%s) to version %s:", configFilePath,
+		from, VERSION)
+	for _, migration := range applied {
+		logInfo("- %s: %s", migration.version, migration.description)
+	}
+	for _, line := range diffLines(string(content), string(migrated)) {
+		logInfo("  %s", line)
+	}
+	backupPath := configFilePath + "." + version + ".bak"
+	if dryRun {
+		logInfo("Dry run, not writing %s or the backup %s", configFilePath,
+			backupPath)
+		return EXIT_SUCCESS, true
+	}
+	if err := writeFileAtomic(backupPath, content); err != nil {
+		logError("Unable to write config file backup %s: %s", backupPath, err)
+		return EXIT_FAILURE, true
+	}
+	if err := writeFileAtomic(configFilePath, migrated); err != nil {
+		logError("Unable to write config file %s: %s", configFilePath, err)
+		return EXIT_FAILURE, true
+	}
+	logInfo("- Migrated config file %s, the old config file is kept at %s",
+		configFilePath, backupPath)
+	config, err := readConfigFile(configFilePath)
+	if err != nil {
+		logError("Unable to parse config file %s: %s", configFilePath, err)
+		return EXIT_CONFIG, true
+	}
+	configData = config
+	return EXIT_SUCCESS, true
+}
+
+// Apply the config migrations newer than the bergelmir_version of the
+// config file content.  migrated is nil if the config file is up to date
+func migrateConfig(content []byte) (version string, migrated []byte,
+	applied []configMigration, err error) {
+	config := map[interface{}]interface{}{}
+	if err = yaml.Unmarshal(content, &config); err != nil {
+		return
+	}
+	if v, ok := config["bergelmir_version"]; ok && v != nil {
+		version = fmt.Sprint(v)
+	}
+	if compareVersions(version, VERSION) > 0 {
+		err = fmt.Errorf("config file version %s is newer than bergelmir "+
+			"version %s", version, VERSION)
+		return
+	}
+	if version == VERSION {
+		return
+	}
+	for _, migration := range configMigrations {
+		if compareVersions(version, migration.version) < 0 {
+			migration.migrate(config)
+			applied = append(applied, migration)
+		}
+	}
+	config["bergelmir_version"] = VERSION
+	// Edit the changed keys in the config file text to keep its comments,
+	// key order and unknown keys
+	original := map[interface{}]interface{}{}
+	if err = yaml.Unmarshal(content, &original); err != nil {
+		return
+	}
+	if migrated, err = editYAMLChanges(content, original, config); err == nil {
+		return
+	}
+	logWarn("Warning: Unable to edit config file %s in place (%s), it is "+
+		"rewritten without its comments", configFilePath, err)
+	migrated, err = yaml.Marshal(config)
+	return
+}
+
+// A changed key of a YAML map, with its path of keys and its new value
+type yamlChange struct {
+	path  []string
+	value interface{}
+}
+
+// Edit the config file content from the original to the migrated YAML
+// map, changing only the lines of the changed keys.  Returns an error if
+// the changes can't be made in the text, such as removed keys or flow
+// style maps
+func editYAMLChanges(content []byte, original,
+	migrated map[interface{}]interface{}) ([]byte, error) {
+	changes, err := yamlChanges(original, migrated, nil)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if string(content) == "" {
+		lines = nil
+	}
+	for _, change := range changes {
+		if lines, err = setYAMLLine(lines, change); err != nil {
+			return nil, err
+		}
+	}
+	edited := []byte(strings.Join(lines, "\n") + "\n")
+	// Only keep the edit if it means the same as the migrated map
+	check := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(edited, &check); err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(check, migrated) {
+		return nil, fmt.Errorf("edited config file differs from the migration")
+	}
+	return edited, nil
+}
+
+// Get the keys that are new or changed in the migrated YAML map, sorted
+// by key
+func yamlChanges(original, migrated map[interface{}]interface{},
+	path []string) ([]yamlChange, error) {
+	for key := range original {
+		if _, ok := migrated[key]; !ok {
+			return nil, fmt.Errorf("key %v is removed", key)
+		}
+	}
+	keys := []string{}
+	for key := range migrated {
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("key %v is not a string", key)
+		}
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	changes := []yamlChange{}
+	for _, key := range keys {
+		keyPath := append(append([]string{}, path...), key)
+		oldValue, newValue := original[key], migrated[key]
+		oldMap, oldIsMap := oldValue.(map[interface{}]interface{})
+		newMap, newIsMap := newValue.(map[interface{}]interface{})
+		if oldIsMap && newIsMap {
+			children, err := yamlChanges(oldMap, newMap, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, children...)
+		} else if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, yamlChange{keyPath, newValue})
+		}
+	}
+	return changes, nil
+}
+
+// Set the key of change in the block style YAML lines, replacing the line
+// of the key or adding it at the end of its parent map
+func setYAMLLine(lines []string, change yamlChange) ([]string, error) {
+	// The lines of the map the key is looked up in, and their indentation
+	start, end, indent := 0, len(lines), 0
+	for i, key := range change.path {
+		keyLine := -1
+		for n := start; n < end; n++ {
+			if yamlLineIndent(lines[n]) == indent &&
+				strings.HasPrefix(strings.TrimSpace(lines[n]), key+":") {
+				keyLine = n
+				break
+			}
+		}
+		if keyLine < 0 {
+			// Add the missing keys after the last line of the parent map
+			value := change.value
+			for j := len(change.path) - 1; j >= i; j-- {
+				value = yaml.MapSlice{{Key: change.path[j], Value: value}}
+			}
+			return insertYAMLLines(lines, lastYAMLContentLine(lines, start,
+				end)+1, indent, value)
+		}
+		if i == len(change.path)-1 {
+			if keyLine+1 < len(lines) && yamlLineIndent(lines[keyLine+1]) > indent &&
+				!isYAMLBlankLine(lines[keyLine+1]) {
+				return nil, fmt.Errorf("key %s has a nested value",
+					strings.Join(change.path, "."))
+			}
+			lines = append(lines[:keyLine], lines[keyLine+1:]...)
+			return insertYAMLLines(lines, keyLine, indent,
+				yaml.MapSlice{{Key: key, Value: change.value}})
+		}
+		// Continue with the lines of the nested map below the key
+		start, end = keyLine+1, keyLine+1
+		for end < len(lines) && (isYAMLBlankLine(lines[end]) ||
+			yamlLineIndent(lines[end]) > indent) {
+			end++
+		}
+		indent += 2
+		for n := start; n < end; n++ {
+			if !isYAMLBlankLine(lines[n]) {
+				indent = yamlLineIndent(lines[n])
+				break
+			}
+		}
+	}
+	return lines, nil
+}
+
+// Insert value encoded as YAML and indented by indent spaces into lines
+// before line n
+func insertYAMLLines(lines []string, n, indent int,
+	value interface{}) ([]string, error) {
+	encoded, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	inserted := strings.Split(strings.TrimSuffix(string(encoded), "\n"), "\n")
+	for i := range inserted {
+		inserted[i] = strings.Repeat(" ", indent) + inserted[i]
+	}
+	result := append(append(append([]string{}, lines[:n]...), inserted...),
+		lines[n:]...)
+	return result, nil
+}
+
+// Get the last line from start to end that is not blank or a comment.
+// Returns start-1 if there is none
+func lastYAMLContentLine(lines []string, start, end int) int {
+	for n := end - 1; n >= start; n-- {
+		if !isYAMLBlankLine(lines[n]) {
+			return n
+		}
+	}
+	return start - 1
+}
+
+// Check if a YAML line is blank or only a comment
+func isYAMLBlankLine(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || strings.HasPrefix(line, "#")
+}
+
+// Get the number of spaces a YAML line is indented by
+func yamlLineIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// Set the dotted YAML key in config to value if it is missing or blank
+func setConfigDefault(config map[interface{}]interface{}, key string,
+	value interface{}) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := config[part].(map[interface{}]interface{})
+		if !ok {
+			child = map[interface{}]interface{}{}
+			config[part] = child
+		}
+		config = child
+	}
+	last := parts[len(parts)-1]
+	if current, ok := config[last]; !ok || current == nil || current == "" {
+		config[last] = value
+	}
+}
+
+// Compare dotted numeric versions a and b.  Returns -1, 0 or 1.  A blank
+// version is older than every other version
+func compareVersions(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	if b == "" {
+		return 1
+	}
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aNum, bNum int
+		if i < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[i])
+		}
+		if aNum != bNum {
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Diff the lines of a and b.  Returns the changed lines prefixed with "-"
+// or "+" and one line of context prefixed with " "
+func diffLines(a, b string) (diff []string) {
+	aLines := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bLines := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	// Longest common subsequence lengths of the line suffixes
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			lines = append(lines, " "+aLines[i])
+			i++
+			j++
+		case j < len(bLines) && (i == len(aLines) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, "+"+bLines[j])
+			j++
+		default:
+			lines = append(lines, "-"+aLines[i])
+			i++
+		}
+	}
+	// Only keep changed lines and the lines next to them
+	for k, line := range lines {
+		changed := func(n int) bool {
+			return n >= 0 && n < len(lines) && lines[n][0] != ' '
+		}
+		if changed(k) || changed(k-1) || changed(k+1) {
+			diff = append(diff, line)
+		} else if len(diff) > 0 && diff[len(diff)-1] != "..." {
+			diff = append(diff, "...")
+		}
+	}
+	if len(diff) > 0 && diff[len(diff)-1] == "..." {
+		diff = diff[:len(diff)-1]
+	}
+	return
+}
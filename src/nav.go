@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// Fewest headings below the page title for a table of contents
+	TABLE_OF_CONTENTS_MIN_HEADINGS = 3
+)
+
+// A post listed on the gemlog page, the RSS feed source page
+type gemlogPost struct {
+	title   string
+	urlPath string
+	date    string
+}
+
+// An entry of the table of contents of a page
+type tocEntry struct {
+	level int
+	text  string
+	// id is the slug id of the heading in the HTML page
+	id string
+}
+
+// Get the URL path of a local Gemtext page link, without the .gmi or
+// .gemini extension.  Relative links are relative to the capsule root like
+// in the RSS feed.  Returns "" for links to other capsules and sites
+func localPagePath(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.IsAbs() || u.Host != "" || u.Path == "" {
+		return ""
+	}
+	pagePath := path.Clean("/" + u.Path)
+	extension := path.Ext(pagePath)
+	if extension == ".gmi" || extension == ".gemini" {
+		pagePath = strings.TrimSuffix(pagePath, extension)
+	}
+	return pagePath
+}
+
+// Get the local posts listed with a date on the gemlog page, newest first
+func getGemlogPosts() (posts []gemlogPost) {
+	source := getConfig().RSS.FeedSourceGeminiPath
+	if source == "" {
+		return
+	}
+	gmi, exists := getGemtextContent("/" + strings.TrimPrefix(source, "/"))
+	if !exists {
+		return
+	}
+	preformattedToggle := false
+	for _, line := range strings.Split(string(gmi), "\n") {
+		g := parseGemtextLine(strings.TrimSuffix(line, "\r"),
+			preformattedToggle)
+		switch g.lineType {
+		case GEMTEXT_PREFORMATTED_TOGGLE:
+			preformattedToggle = !preformattedToggle
+		case GEMTEXT_LINK:
+			match := geminiFeedRe.FindStringSubmatch(g.text)
+			pagePath := localPagePath(g.path)
+			if len(match) > 0 && pagePath != "" {
+				posts = append(posts, gemlogPost{title: match[2],
+					urlPath: pagePath, date: match[1]})
+			}
+		}
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].date > posts[j].date
+	})
+	return
+}
+
+// Get the posts before and after the post at URL path urlPath on the
+// gemlog page.  Both are nil if urlPath is not a listed post
+func getAdjacentPosts(urlPath string) (previous, next *gemlogPost) {
+	posts := getGemlogPosts()
+	for i, post := range posts {
+		if post.urlPath != urlPath {
+			continue
+		}
+		// Posts are newest first
+		if i+1 < len(posts) {
+			previous = &posts[i+1]
+		}
+		if i > 0 {
+			next = &posts[i-1]
+		}
+		return
+	}
+	return
+}
+
+// Get the table of contents of a Gemtext page, the headings after the page
+// title.  Pages with fewer than TABLE_OF_CONTENTS_MIN_HEADINGS headings
+// have none
+func getTableOfContents(gmi string) (toc []tocEntry) {
+	ids := map[string]bool{}
+	titleSkipped := false
+	for _, heading := range gemtextHeadings(gmi) {
+		// The ids match the ones of translateGemtextToHTML
+		id := headingSlug(heading.text, ids)
+		if heading.level == 1 && !titleSkipped {
+			titleSkipped = true
+			continue
+		}
+		toc = append(toc, tocEntry{heading.level, heading.text, id})
+	}
+	if len(toc) < TABLE_OF_CONTENTS_MIN_HEADINGS {
+		return nil
+	}
+	return toc
+}
+
+// Add the navigation enabled in gemini.navigation to the Gemtext page at
+// URL path urlPath: breadcrumb links at the top, a table of contents after
+// the page title and links to the previous and next gemlog posts at the
+// bottom
+func addGemtextNavigation(urlPath string, gmi []byte) []byte {
+	navigation := getConfig().Gemini.Navigation
+	if !navigation.Breadcrumbs && !navigation.TableOfContents &&
+		!navigation.PostLinks {
+		return gmi
+	}
+	var top, contents, bottom strings.Builder
+	if navigation.Breadcrumbs {
+		breadcrumbs := getBreadcrumbs(urlPath)
+		for _, breadcrumb := range breadcrumbs[:len(breadcrumbs)-1] {
+			top.WriteString("=> " + breadcrumb.URL + " " + breadcrumb.Title +
+				"\n")
+		}
+		if top.Len() > 0 {
+			top.WriteString("\n")
+		}
+	}
+	if navigation.TableOfContents {
+		if toc := getTableOfContents(string(gmi)); toc != nil {
+			contents.WriteString("\n## Contents\n")
+			for _, entry := range toc {
+				contents.WriteString("* " + entry.text + "\n")
+			}
+			contents.WriteString("\n")
+		}
+	}
+	if navigation.PostLinks {
+		previous, next := getAdjacentPosts(urlPath)
+		if previous != nil || next != nil {
+			bottom.WriteString("\n")
+		}
+		if previous != nil {
+			bottom.WriteString("=> " + previous.urlPath + " Previous: " +
+				previous.title + "\n")
+		}
+		if next != nil {
+			bottom.WriteString("=> " + next.urlPath + " Next: " + next.title +
+				"\n")
+		}
+	}
+	page := strings.TrimSuffix(string(gmi), "\n")
+	if contents.Len() > 0 {
+		// The table of contents goes after the page title if there is one
+		lines := strings.SplitAfter(page, "\n")
+		if g := parseGemtextLine(strings.TrimRight(lines[0], "\r\n"),
+			false); g.lineType == GEMTEXT_HEADING && g.level == 1 {
+			page = lines[0] + contents.String() + strings.Join(lines[1:], "")
+		} else {
+			page = contents.String() + page
+		}
+	}
+	if page != "" && !strings.HasSuffix(page, "\n") {
+		page += "\n"
+	}
+	return []byte(top.String() + page + bottom.String())
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Run `bergelmir onion <subcommand>` and return the exit code
+func runOnionCommand(subcommand string) int {
+	switch subcommand {
+	case "address":
+		return printOnionAddress()
+	default:
+		fmt.Printf("Usage: %s onion <subcommand>\n\n", bergelmirCmd)
+		fmt.Println("Subcommands:")
+		fmt.Println("  address  Show the onion address of the tor hidden " +
+			"service private key")
+		if subcommand != "help" {
+			return EXIT_USAGE
+		}
+		return EXIT_SUCCESS
+	}
+}
+
+// Print the onion address of the tor hidden service private key without
+// starting tor.  Returns the exit code
+func printOnionAddress() int {
+	content, err := readFileDecrypted(configData.Tor.HiddenServicePrivateKeyPath)
+	if err != nil {
+		logError("Unable to read tor hidden service private key %s: %s",
+			configData.Tor.HiddenServicePrivateKeyPath, err)
+		return EXIT_FAILURE
+	}
+	onionAddress, err := onionAddressFromKeyFile(content)
+	if err != nil {
+		logError("Tor hidden service private key %s is corrupt: %s",
+			configData.Tor.HiddenServicePrivateKeyPath, err)
+		return EXIT_FAILURE
+	}
+	fmt.Println(onionAddress)
+	return EXIT_SUCCESS
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Reread and validate the config file and apply it without dropping the
+// listeners.  Settings read for every request (data paths, layout, page
+// title, RSS and HTTPS redirects) apply immediately, the TLS certificate is
+// reloaded, and only listeners with a changed listening location are
+// restarted.  The config is kept if the config file has problems
+func reloadConfig() {
+	config, err := readConfigFile(configFilePath)
+	if err != nil {
+		logWarn("- Unable to reread config file %s, keeping current "+
+			"config: %s", configFilePath, err)
+		return
+	}
+	problems := validateConfig(config)
+	errorCount := countConfigErrors(problems)
+	if errorCount > 0 {
+		logWarn("- Config file %s has %d problem(s), keeping current config:",
+			configFilePath, errorCount)
+	}
+	for _, problem := range problems {
+		if !problem.warning {
+			logWarn("  %s: %s", problem.key, problem.message)
+		} else if errorCount == 0 {
+			logWarn("- Warning: %s: %s", problem.key, problem.message)
+		}
+	}
+	if errorCount > 0 {
+		return
+	}
+	oldConfig := getConfig()
+	httpsEnabled := config.HTTP.Enabled && config.HTTP.HTTPS.Enabled
+	oldHTTPSEnabled := oldConfig.HTTP.Enabled && oldConfig.HTTP.HTTPS.Enabled
+	var manager *autocert.Manager
+	if httpsEnabled && (!oldHTTPSEnabled ||
+		!reflect.DeepEqual(config.HTTP.HTTPS.ACME, oldConfig.HTTP.HTTPS.ACME) ||
+		!reflect.DeepEqual(config.Gemini.DomainNames,
+			oldConfig.Gemini.DomainNames)) {
+		if manager, err = newACMEManager(config); err != nil {
+			logWarn("- Unable to create ACME certificate manager, keeping "+
+				"current config: %s", err)
+			return
+		}
+	}
+	if oldConfig.Gemini.DataPath != config.Gemini.DataPath ||
+		oldConfig.Gemini.SealedContentPath != config.Gemini.SealedContentPath {
+		content, err := openGeminiContent(config)
+		if err != nil {
+			logWarn("- Unable to open Gemini content, keeping current "+
+				"config: %s", err)
+			return
+		}
+		setGeminiContent(content)
+		logInfo("- Reloaded Gemini capsule content")
+	}
+	geminiTLSReloadLock.Lock()
+	setConfig(config)
+	geminiTLSReloadLock.Unlock()
+	// Domain name changes need a new self-signed TLS certificate
+	setGeminiHostList()
+	reloadGeminiTLSCert(true)
+
+	if config.Gemini.ListeningLocation != oldConfig.Gemini.ListeningLocation {
+		restartListener(geminiListener, config.Gemini.ListeningLocation)
+	}
+	if manager != nil {
+		// The HTTPS listener gets certificates from the current manager
+		setACMEManager(manager)
+		logInfo("- Reloaded ACME certificate manager")
+	}
+	switch {
+	case !config.HTTP.Enabled:
+		stopListener(httpListener)
+	case httpServer == nil:
+		logInfo("- Starting HTTP server at http://%s",
+			config.HTTP.ListeningLocation)
+		if err := startHTTPServer(); err != nil {
+			logWarn("- Unable to start HTTP server: %s", err)
+		}
+	case config.HTTP.ListeningLocation != oldConfig.HTTP.ListeningLocation ||
+		!httpListener.running():
+		restartListener(httpListener, config.HTTP.ListeningLocation)
+	}
+	switch {
+	case !httpsEnabled:
+		stopListener(httpsListener)
+	case httpsServer == nil:
+		logInfo("- Starting HTTPS server at https://%s",
+			config.HTTP.HTTPS.ListeningLocation)
+		if err := startHTTPSServer(); err != nil {
+			logWarn("- Unable to start HTTPS server: %s", err)
+		}
+	case config.HTTP.HTTPS.ListeningLocation !=
+		oldConfig.HTTP.HTTPS.ListeningLocation || !httpsListener.running():
+		restartListener(httpsListener, config.HTTP.HTTPS.ListeningLocation)
+	}
+
+	// Tor itself is only configured when it starts
+	oldTor, newTor := oldConfig.Tor, config.Tor
+	oldTor.Enabled, newTor.Enabled = false, false
+	if config.Tor.Enabled != oldConfig.Tor.Enabled ||
+		!reflect.DeepEqual(oldTor, newTor) {
+		logWarn("- Tor settings changed, restart bergelmir to apply them")
+	}
+	address := getTorAddress()
+	if config.Tor.Enabled && oldConfig.Tor.Enabled && address != "" &&
+		(config.Gemini.Tor.VirtualPort != oldConfig.Gemini.Tor.VirtualPort ||
+			config.HTTP.Tor.VirtualPort != oldConfig.HTTP.Tor.VirtualPort ||
+			config.Gemini.ListeningLocation != oldConfig.Gemini.ListeningLocation ||
+			config.HTTP.ListeningLocation != oldConfig.HTTP.ListeningLocation) {
+		if err := republishOnion(); err != nil {
+			logWarn("- Unable to republish onion service %s: %s",
+				address, err)
+		} else {
+			logInfo("- Republished onion service %s", address)
+		}
+	}
+	logInfo("- Reloaded config file %s", configFilePath)
+}
+
+// Move a running server listener to location
+func restartListener(s *serverListener, location string) {
+	if err := s.start(location); err != nil {
+		logWarn("- Unable to move %s to %s, still listening at %s: %s",
+			s.name, location, s.getLocation(), err)
+		if !s.running() {
+			logError("- %s is not listening", s.name)
+		}
+		return
+	}
+	logInfo("- %s is listening at %s", s.name, location)
+}
+
+// Stop a server listener if it is running
+func stopListener(s *serverListener) {
+	if s.running() {
+		s.stop()
+		logInfo("- Stopped %s", s.name)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	ROBOTS_PROTOCOL_GEMINI = "gemini"
+	ROBOTS_PROTOCOL_HTTP   = "http"
+)
+
+var (
+	robotsProtocols = []string{ROBOTS_PROTOCOL_GEMINI, ROBOTS_PROTOCOL_HTTP}
+	// Virtual user agents of the Gemini robots.txt companion specification,
+	// for crawlers by their purpose
+	geminiVirtualAgents = []string{"archiver", "indexer", "researcher",
+		"webproxy"}
+)
+
+// Check if a robots.txt rule applies to protocol.  Rules without protocols
+// apply to both
+func robotsRuleApplies(rule ConfigRobotsRule, protocol string) bool {
+	return len(rule.Protocols) == 0 || stringInSlice(protocol, rule.Protocols)
+}
+
+// Generate the robots.txt of protocol from the robots.rules config.
+// sitemapURL is added for web crawlers if set.  Returns "" if no rules
+// apply to protocol
+func generateRobotsTxt(protocol, sitemapURL string) string {
+	var robots strings.Builder
+	for _, rule := range getConfig().Robots.Rules {
+		if !robotsRuleApplies(rule, protocol) || len(rule.UserAgents) == 0 {
+			continue
+		}
+		if robots.Len() > 0 {
+			robots.WriteString("\n")
+		}
+		for _, agent := range rule.UserAgents {
+			robots.WriteString("User-agent: " + agent + "\n")
+		}
+		// Gemini robots.txt only knows Disallow lines
+		if protocol == ROBOTS_PROTOCOL_HTTP {
+			for _, allow := range rule.Allow {
+				robots.WriteString("Allow: " + allow + "\n")
+			}
+		}
+		for _, disallow := range rule.Disallow {
+			robots.WriteString("Disallow: " + disallow + "\n")
+		}
+		if len(rule.Disallow) == 0 {
+			robots.WriteString("Disallow:\n")
+		}
+	}
+	if robots.Len() > 0 && sitemapURL != "" {
+		robots.WriteString("\nSitemap: " + sitemapURL + "\n")
+	}
+	return robots.String()
+}
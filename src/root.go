@@ -0,0 +1,238 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Symlinks are not followed
+	SYMLINKS_DENY = "deny"
+	// Symlinks are followed if they point into the same data root
+	SYMLINKS_WITHIN_ROOT = "within_root"
+	// Symlinks are followed wherever they point
+	SYMLINKS_FOLLOW = "follow"
+)
+
+var (
+	symlinkPolicies = []string{SYMLINKS_DENY, SYMLINKS_WITHIN_ROOT,
+		SYMLINKS_FOLLOW}
+	// Default patterns of file and directory names that are never served,
+	// such as dotfiles and editor backup files
+	defaultDenyPatterns = []string{".*", "*~", "#*#", "*.bak", "*.orig",
+		"*.swp"}
+	// Default patterns of names that are served although they are denied
+	defaultAllowPatterns = []string{".well-known"}
+)
+
+// A data root directory that only serves the files inside it.  Names are
+// resolved one path element at a time, symlinks are handled by the
+// files.symlinks policy and names matching the files.deny_patterns are not
+// found.  The opened file is checked to be the file that was resolved, but
+// unlike an os.Root a directory of the path that is replaced by a symlink
+// between resolving and opening is followed, so the data root must not be
+// writable by untrusted users
+type dataRoot string
+
+// Content that hides the names matching the files.deny_patterns, for
+// content without symlinks such as sealed content
+type filteredFS struct {
+	fs.FS
+}
+
+// A directory of a data root that leaves the denied names out of its
+// entries
+type dataRootDir struct {
+	*os.File
+	root dataRoot
+	name string
+}
+
+// Get the file and directory name patterns that are never served, and the
+// exceptions to them
+func getFilePatterns() (deny, allow []string) {
+	files := getConfig().Files
+	deny, allow = files.DenyPatterns, files.AllowPatterns
+	if deny == nil {
+		deny = defaultDenyPatterns
+	}
+	if allow == nil {
+		allow = defaultAllowPatterns
+	}
+	return
+}
+
+// Check if any path element of the slash separated name matches a deny
+// pattern and no allow pattern
+func isDeniedName(name string) bool {
+	deny, allow := getFilePatterns()
+	for _, element := range strings.Split(name, "/") {
+		if element == "." || element == "" {
+			continue
+		}
+		if matchesAnyPattern(element, deny) &&
+			!matchesAnyPattern(element, allow) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if name matches any of the path.Match patterns
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the symlink policy from the config
+func getSymlinkPolicy() string {
+	if policy := getConfig().Files.Symlinks; policy != "" {
+		return policy
+	}
+	return SYMLINKS_WITHIN_ROOT
+}
+
+// Check if path is dir or inside it.  Both are clean absolute paths
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Resolve the fs.FS name inside the data root to a file path, following
+// symlinks by the symlink policy.  Names that leave the data root or are
+// denied do not exist
+func (root dataRoot) resolve(op, name string) (string, error) {
+	notFound := &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	if !fs.ValidPath(name) || isDeniedName(name) {
+		return "", notFound
+	}
+	rootPath, err := filepath.EvalSymlinks(string(root))
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	rootPath, err = filepath.Abs(rootPath)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if name == "." {
+		return rootPath, nil
+	}
+	policy := getSymlinkPolicy()
+	current := rootPath
+	for _, element := range strings.Split(name, "/") {
+		next := filepath.Join(current, element)
+		info, err := os.Lstat(next)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if policy == SYMLINKS_DENY {
+				return "", notFound
+			}
+			target, err := filepath.EvalSymlinks(next)
+			if err != nil {
+				return "", &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			if target, err = filepath.Abs(target); err != nil {
+				return "", &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			if policy != SYMLINKS_FOLLOW {
+				if !isWithinDir(rootPath, target) {
+					return "", notFound
+				}
+				// The target must not be a denied name either
+				rel, _ := filepath.Rel(rootPath, target)
+				if isDeniedName(filepath.ToSlash(rel)) {
+					return "", notFound
+				}
+			}
+			next = target
+		}
+		current = next
+	}
+	return current, nil
+}
+
+func (root dataRoot) Open(name string) (fs.File, error) {
+	filePath, err := root.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := os.Lstat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if resolved.Mode()&fs.ModeSymlink != 0 {
+		// Replaced by a symlink since it was resolved
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !os.SameFile(resolved, info) {
+		// Replaced since it was resolved
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if info.IsDir() {
+		return &dataRootDir{File: f, root: root, name: name}, nil
+	}
+	return f, nil
+}
+
+func (root dataRoot) Stat(name string) (fs.FileInfo, error) {
+	filePath, err := root.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(filePath)
+	if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return info, err
+}
+
+// Get the directory entries that can be opened in the data root
+func (d *dataRootDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.File.ReadDir(n)
+	allowed := entries[:0]
+	for _, entry := range entries {
+		if _, resolveErr := d.root.resolve("readdir",
+			path.Join(d.name, entry.Name())); resolveErr == nil {
+			allowed = append(allowed, entry)
+		}
+	}
+	return allowed, err
+}
+
+func (f filteredFS) Open(name string) (fs.File, error) {
+	if isDeniedName(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.FS.Open(name)
+}
+
+func (f filteredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.FS, name)
+	allowed := entries[:0]
+	for _, entry := range entries {
+		if !isDeniedName(path.Join(name, entry.Name())) {
+			allowed = append(allowed, entry)
+		}
+	}
+	return allowed, err
+}
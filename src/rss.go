@@ -20,14 +20,30 @@ type feedEntry struct {
 
 // Check if rss value in config is enabled and if url is /feed or /rss
 func isRSSFeed(url string) bool {
-	return (configData.RSS.Enabled &&
+	return (getConfig().RSS.Enabled &&
 		(url == "/feed" || url == "/rss"))
 }
 
+// Print the RSS feed with links relative to baseURL.  Returns the exit
+// code
+func printFeed(baseURL string) int {
+	if baseURL == "" {
+		baseURL = "gemini://" + getDomainList()[0]
+	}
+	loadGeminiContent()
+	feed := createRSSFeed(baseURL)
+	if feed == "" {
+		logError("No feed entries in Gemini page %s",
+			configData.RSS.FeedSourceGeminiPath)
+		return EXIT_FAILURE
+	}
+	fmt.Println(feed)
+	return EXIT_SUCCESS
+}
+
 func createRSSFeed(host string) string {
-	rssGeminiDataPath := configData.Gemini.DataPath + "/" +
-		configData.RSS.FeedSourceGeminiPath
-	gmiContent, exists := getGemtextContent(rssGeminiDataPath)
+	gmiContent, exists := getGemtextContent(
+		getConfig().RSS.FeedSourceGeminiPath)
 	if exists {
 		return translateGemtextToRSS(string(gmiContent), host)
 	}
@@ -36,7 +52,7 @@ func createRSSFeed(host string) string {
 
 func translateGemtextToRSS(gmi, host string) (rssFeedString string) {
 	rssFeedURL := joinPath(host,
-		configData.RSS.FeedSourceGeminiPath)
+		getConfig().RSS.FeedSourceGeminiPath)
 	rssFeedEntries := []feedEntry{}
 	feedTitle := ""
 	gmi = strings.ReplaceAll(gmi, "\r\n", "\n")
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	HSTS_HEADER = "Strict-Transport-Security"
+)
+
+// Default security headers of HTTP responses.  The HTML pages are generated
+// from Gemtext and need no scripts, so the Content-Security-Policy only
+// allows images, stylesheets, fonts and media from the HTTP mirror itself.
+// Pages look the same with scripts disabled, such as in Tor Browser at its
+// safest setting.  Strict-Transport-Security is only sent over HTTPS
+var defaultHTTPSecurityHeaders = map[string]string{
+	"Content-Security-Policy": "default-src 'none'; img-src 'self'; " +
+		"style-src 'self'; font-src 'self'; media-src 'self'; " +
+		"base-uri 'none'; form-action 'none'; frame-ancestors 'none'",
+	"X-Content-Type-Options": "nosniff",
+	"Referrer-Policy":        "no-referrer",
+	"Permissions-Policy": "accelerometer=(), camera=(), geolocation=(), " +
+		"gyroscope=(), magnetometer=(), microphone=(), payment=(), usb=()",
+	HSTS_HEADER: "max-age=31536000",
+}
+
+// Get the security headers from the config merged over the defaults.  A
+// header set to "" in the config is not sent
+func getSecurityHeaders() map[string]string {
+	headers := map[string]string{}
+	for name, value := range defaultHTTPSecurityHeaders {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	for name, value := range getConfig().HTTP.SecurityHeaders {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	return headers
+}
+
+// Set the security headers on every response of handler
+func securityHeadersHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range getSecurityHeaders() {
+			if value == "" || (name == HSTS_HEADER && r.TLS == nil) {
+				continue
+			}
+			w.Header().Set(name, value)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Check if name is a valid HTTP header name
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > '~' || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}",
+			c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Default seconds to wait for open connections when shutting down
+	SHUTDOWN_DEFAULT_TIMEOUT = 10
+)
+
+// Stop accepting connections and wait for open Gemini connections and HTTP
+// requests until the shutdown timeout, then close what is left and stop
+// tor.  Returns EXIT_FAILURE if connections had to be closed
+func shutdown() int {
+	timeout := time.Duration(getConfig().ShutdownTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = SHUTDOWN_DEFAULT_TIMEOUT * time.Second
+	}
+	logInfo("Shutting down, waiting up to %s for open connections", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Once the Gemini listener is stopped no connection is added to
+	// geminiConnectionsDone anymore, so it can be waited for
+	geminiListener.stop()
+	httpListener.stop()
+	httpsListener.stop()
+
+	var wg sync.WaitGroup
+	var drainedLock sync.Mutex
+	drained := true
+	for _, srv := range []*http.Server{httpServer, httpsServer} {
+		if srv == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+				drainedLock.Lock()
+				drained = false
+				drainedLock.Unlock()
+			}
+		}(srv)
+	}
+	geminiDrained := waitGeminiConnections(ctx)
+	wg.Wait()
+	drained = drained && geminiDrained
+	killTor()
+	if !drained {
+		logWarn("- Closed connections still open after %s", timeout)
+		return EXIT_FAILURE
+	}
+	logInfo("- All connections finished")
+	return EXIT_SUCCESS
+}
+
+// Wait for the open Gemini capsule connections to finish until ctx is done,
+// then close the remaining connections.  Returns false if connections had
+// to be closed
+func waitGeminiConnections(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		geminiConnectionsDone.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+	geminiConnectionsLock.Lock()
+	for conn := range geminiConnections {
+		conn.Close()
+	}
+	geminiConnectionsLock.Unlock()
+	<-done
+	return false
+}
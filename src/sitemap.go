@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SITEMAP_PATH = "/sitemap.xml"
+)
+
+// A page in the sitemap
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Get the URL paths of the Gemtext pages of the Gemini capsule content
+// with their last modification times
+func getGemtextPages() (pages map[string]time.Time, err error) {
+	pages = map[string]time.Time{}
+	err = fs.WalkDir(getGeminiContent(), ".", func(name string,
+		d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		extension := path.Ext(name)
+		if extension != ".gmi" && extension != ".gemini" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		urlPath := "/" + strings.TrimSuffix(name, extension)
+		// getGemtextContent prefers .gmi over .gemini
+		if _, exists := pages[urlPath]; !exists || extension == ".gmi" {
+			pages[urlPath] = info.ModTime()
+		}
+		return nil
+	})
+	return
+}
+
+// Generate the sitemap.xml of the HTML mirror at baseURL with the Gemtext
+// pages of the Gemini capsule.  The pages of a static build have the .html
+// file names of `bergelmir build`
+func generateSitemap(baseURL string, staticBuild bool) ([]byte, error) {
+	pages, err := getGemtextPages()
+	if err != nil {
+		return nil, err
+	}
+	urlPaths := make([]string, 0, len(pages))
+	for urlPath := range pages {
+		urlPaths = append(urlPaths, urlPath)
+	}
+	sort.Strings(urlPaths)
+	sitemap := struct {
+		XMLName xml.Name     `xml:"urlset"`
+		XMLNS   string       `xml:"xmlns,attr"`
+		URLs    []sitemapURL `xml:"url"`
+	}{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, urlPath := range urlPaths {
+		// Like the canonical URLs of the HTML layout
+		pagePath := urlPath
+		if pagePath == "/index" {
+			pagePath = "/"
+		} else if staticBuild {
+			pagePath += ".html"
+		}
+		sitemap.URLs = append(sitemap.URLs, sitemapURL{
+			Loc:     baseURL + (&url.URL{Path: pagePath}).String(),
+			LastMod: pages[urlPath].UTC().Format(time.RFC3339),
+		})
+	}
+	content, err := xml.MarshalIndent(sitemap, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(content, '\n')...), nil
+}
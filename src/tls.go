@@ -4,6 +4,7 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -13,43 +14,118 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	TLS_FILE_WATCH_INTERVAL = 10 * time.Second
+	TLS_KEY_TYPE_ED25519    = "ed25519"
+	TLS_KEY_TYPE_ECDSA_P256 = "ecdsa-p256"
+	TLS_KEY_TYPE_ECDSA_P384 = "ecdsa-p384"
+	TLS_KEY_TYPE_RSA_2048   = "rsa-2048"
+	TLS_KEY_TYPE_RSA_3072   = "rsa-3072"
+	TLS_KEY_TYPE_RSA_4096   = "rsa-4096"
+)
+
+var (
+	tlsKeyTypes = []string{TLS_KEY_TYPE_ED25519, TLS_KEY_TYPE_ECDSA_P256,
+		TLS_KEY_TYPE_ECDSA_P384, TLS_KEY_TYPE_RSA_2048, TLS_KEY_TYPE_RSA_3072,
+		TLS_KEY_TYPE_RSA_4096}
+)
+
+var (
+	geminiTLSCert       *tls.Certificate
+	geminiTLSCertFiles  tlsFileState
+	geminiTLSCertLock   sync.RWMutex
+	geminiTLSReloadLock sync.Mutex
+)
+
+// Modification state of the TLS certificate and key files
+type tlsFileState struct {
+	certModTime time.Time
+	certSize    int64
+	keyModTime  time.Time
+	keySize     int64
+}
+
 func getDomainList() (domainList []string) {
-	domainList = configData.Gemini.DomainNames[:]
+	domainList = append(domainList, configData.Gemini.DomainNames...)
 	if len(domainList) == 0 {
 		domainList = append(domainList, "localhost")
 	}
-	if torAddress != "" {
-		domainList = append(domainList, torAddress)
+	if address := getTorAddress(); address != "" {
+		domainList = append(domainList, address)
 	}
 	return
 }
 
-// Generate self-signed TLS certificate and key.  Uses ed25519 for the
-// private key
-func generateNewTLSCertAndKey() (cert, key []byte) {
-	_, privKey, err := ed25519.GenerateKey(rand.Reader)
-	handleErr(err, "Unable to generate TLS ed25519 private key")
+// Generate self-signed TLS certificate and key.  Uses the config TLS key
+// type for the private key
+func generateNewTLSCertAndKey() (cert, key []byte, err error) {
+	privKey, err := generateTLSKey(configData.Gemini.TLS.KeyType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate TLS private key: %w",
+			err)
+	}
 	return generateNewTLSCertFromKey(privKey)
 }
 
+// Generate TLS private key of keyType.  Defaults to ed25519 if keyType is
+// blank
+func generateTLSKey(keyType string) (crypto.PrivateKey, error) {
+	switch strings.ToLower(keyType) {
+	case "", TLS_KEY_TYPE_ED25519:
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		return privKey, err
+	case TLS_KEY_TYPE_ECDSA_P256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case TLS_KEY_TYPE_ECDSA_P384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case TLS_KEY_TYPE_RSA_2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case TLS_KEY_TYPE_RSA_3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case TLS_KEY_TYPE_RSA_4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("unknown TLS key type %q", keyType)
+}
+
+// Get the TLS key type of privKey (ed25519, ecdsa-p256, rsa-2048, etc.)
+func tlsKeyType(privKey crypto.PrivateKey) string {
+	return tlsPublicKeyType(publicKeyFromPrivateKey(privKey))
+}
+
+// Get the NotBefore and NotAfter values of a new TLS certificate.  If the
+// config TLS validity days is 0, the TLS certificate is valid from January
+// 1st, 2000 to January 1st, 2200 at midnight UTC so it effectively never
+// needs to be replaced
+func getTLSCertValidity() (notBefore, notAfter time.Time) {
+	if configData.Gemini.TLS.ValidityDays > 0 {
+		// Start an hour early to allow for client clock skew
+		notBefore = time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+		notAfter = notBefore.AddDate(0, 0, configData.Gemini.TLS.ValidityDays)
+		return
+	}
+	notBefore = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	notAfter = time.Date(2200, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return
+}
+
 // Generate self-signed TLS certificate from private key.
-func generateNewTLSCertFromKey(privKey crypto.PrivateKey) (cert, key []byte) {
-	// Generate TLS ed25519 key
+func generateNewTLSCertFromKey(privKey crypto.PrivateKey) (cert, key []byte,
+	err error) {
 	pubKey := publicKeyFromPrivateKey(privKey)
 	// Get random 128-bit integer (bigInt)
 	serialNumber, err := rand.Int(rand.Reader,
 		new(big.Int).Lsh(big.NewInt(1), 128))
-	handleErr(err, "Unable to generate random 128-bit integer for TLS "+
-		"certificate serial number")
-	// Set NotBefore to January 1st, 2000 at midnight UTC
-	notBefore, err := time.Parse(time.RFC3339, "2000-01-01T00:00:00Z")
-	handleErr(err, "Unable to create NotBefore value for TLS certificate")
-	// Set NotAfter to January 1st, 2200 at midnight UTC
-	notAfter, err := time.Parse(time.RFC3339, "2200-01-01T00:00:00Z")
-	handleErr(err, "Unable to create NotAfter value for TLS certificate")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate TLS certificate "+
+			"serial number: %w", err)
+	}
+	notBefore, notAfter := getTLSCertValidity()
 	keyUsage := x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
 	if _, keyIsRSA := privKey.(*rsa.PrivateKey); keyIsRSA {
 		// Set KeyEncipherment KeyUsage bit if privKey is RSA
@@ -57,7 +133,7 @@ func generateNewTLSCertFromKey(privKey crypto.PrivateKey) (cert, key []byte) {
 	}
 	tlsCertTemplate := x509.Certificate{
 		SerialNumber:          serialNumber,
-		Subject:               pkix.Name{},
+		Subject:               pkix.Name{CommonName: configData.Gemini.TLS.CommonName},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
 		KeyUsage:              keyUsage,
@@ -66,16 +142,22 @@ func generateNewTLSCertFromKey(privKey crypto.PrivateKey) (cert, key []byte) {
 		IsCA:                  true,
 		DNSNames:              getDomainList(),
 	}
-	// Create x509 certificate from tls certificate template and ed25519
-	// public/private key
+	// Create x509 certificate from tls certificate template and public/private
+	// key
 	certDERBytes, err := x509.CreateCertificate(rand.Reader, &tlsCertTemplate,
 		&tlsCertTemplate, pubKey, privKey)
-	handleErr(err, "Unable to generate TLS certificate")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate TLS certificate: %w",
+			err)
+	}
 	// Encode x509 certificate to pem encoding
 	cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
 		Bytes: certDERBytes})
-	// Create x509 private key from ed25519 private key
+	// Create x509 private key from private key
 	privKeyBytes, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, nil, err
+	}
 	// Encode x509 private key to pem encoding
 	key = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY",
 		Bytes: privKeyBytes})
@@ -83,43 +165,101 @@ func generateNewTLSCertFromKey(privKey crypto.PrivateKey) (cert, key []byte) {
 }
 
 func loadTLSCert() tls.Certificate {
+	cert, err := readTLSCert(true)
+	handleErr(err, "Unable to load TLS certificate and key")
+	return cert
+}
+
+// Read TLS certificate and key from the config TLS paths.  If the TLS
+// certificate and key can't be loaded and generateMissing is true, a new
+// self-signed TLS certificate (and TLS key if there is no valid TLS key) is
+// generated.  A new TLS certificate is always generated from the TLS key if
+// the domain names of the gemini capsule are not the TLS certificate domain
+// names
+func readTLSCert(generateMissing bool) (tls.Certificate, error) {
 	// tlsPrivKey will be the TLS private key if it exists and is valid,
 	// otherwise will be nil
-	tlsPrivKey := getTLSKey()
+	tlsPrivKey, err := getTLSKey()
+	if err != nil {
+		// TLS key exists but can't be decrypted, so don't replace it
+		return tls.Certificate{}, err
+	}
 	// Attempt to read/load TLS certificate and key
-	cert, err := tls.LoadX509KeyPair(configData.Gemini.TLS.CertPath,
-		configData.Gemini.TLS.KeyPath)
+	cert, err := loadTLSKeyPair()
 	if err != nil {
+		if !generateMissing {
+			return cert, err
+		}
 		// Could not load TLS certificate and key
 		var tlsCert []byte
 		var tlsKey []byte
 		if tlsPrivKey == nil {
 			// No valid TLS key, so generate TLS certificate and key
-			fmt.Println("- Generating new TLS certificate and TLS private key")
-			tlsCert, tlsKey = generateNewTLSCertAndKey()
+			logInfo("- Generating new TLS certificate and TLS private key")
+			tlsCert, tlsKey, err = generateNewTLSCertAndKey()
 		} else {
 			// Valid TLS key, so generate TLS certificate
-			fmt.Println("- Generating new TLS certificate")
-			tlsCert, tlsKey = generateNewTLSCertFromKey(tlsPrivKey)
+			logInfo("- Generating new TLS certificate")
+			tlsCert, tlsKey, err = generateNewTLSCertFromKey(tlsPrivKey)
+		}
+		if err != nil {
+			return tls.Certificate{}, err
 		}
 		// Write generated TLS certificate to cert path
-		fmt.Printf("- Writing TLS certificate to %s\n", configData.Gemini.TLS.CertPath)
-		writeTLSCert(tlsCert)
+		logInfo("- Writing TLS certificate to %s", configData.Gemini.TLS.CertPath)
+		if err := writeTLSCert(tlsCert); err != nil {
+			return tls.Certificate{}, err
+		}
 		if tlsPrivKey == nil {
 			// Write generated TLS private key to key path if not valid TLS key
-			fmt.Printf("- Writing TLS private key to %s\n", configData.Gemini.TLS.KeyPath)
-			writeTLSKey(tlsKey)
+			logInfo("- Writing TLS private key to %s", configData.Gemini.TLS.KeyPath)
+			if err := writeTLSKey(tlsKey); err != nil {
+				return tls.Certificate{}, err
+			}
 		}
 		// Load generated TLS certificate and key
-		cert, err = tls.X509KeyPair(tlsCert, tlsKey)
-		handleErr(err, "Unable to load generated TLS certificate and key")
-		return cert
+		return tls.X509KeyPair(tlsCert, tlsKey)
 	}
 	// Get x509 certificate data from TLS certificate
 	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
-	handleErr(err, "Unable to parse TLS certificate")
-	// Check if all domain names for gemini capsule are in TLS certificate
-	domainList := getDomainList()
+	if err != nil {
+		return cert, err
+	}
+	if keyType := tlsKeyType(cert.PrivateKey); keyType != getTLSKeyTypeOrDefault() {
+		logWarn("- TLS private key type %s is not the configured TLS key "+
+			"type %s.  Use `%s cert regenerate` to replace it", keyType,
+			getTLSKeyTypeOrDefault(), bergelmirCmd)
+	}
+	if tlsCertExpiresSoon(x509Cert) {
+		// Replacing the certificate would break the TOFU pins of clients,
+		// so that is left to the capsule owner
+		logWarn("- TLS certificate expires on %s.  Use `%s cert regenerate` "+
+			"to replace it", x509Cert.NotAfter.Format("2006-01-02"),
+			bergelmirCmd)
+	}
+	if !tlsCertHasDomains(x509Cert, getDomainList()) {
+		// Domain is not in cert or cert contains a domain not in the domain
+		// list so generate and write new TLS certificate (but not key)
+		logInfo("- Generating new TLS certificate from TLS private key")
+		tlsCert, tlsKey, err := generateNewTLSCertFromKey(cert.PrivateKey)
+		if err != nil {
+			return cert, err
+		}
+		logInfo("- Writing TLS certificate to %s", configData.Gemini.TLS.CertPath)
+		if err := writeTLSCert(tlsCert); err != nil {
+			return cert, err
+		}
+		return tls.X509KeyPair(tlsCert, tlsKey)
+	}
+	return cert, nil
+}
+
+// Check if the TLS certificate DNS names are exactly the domains in
+// domainList
+func tlsCertHasDomains(x509Cert *x509.Certificate, domainList []string) bool {
+	if len(domainList) != len(x509Cert.DNSNames) {
+		return false
+	}
 	for _, domain := range domainList {
 		domainInCert := false
 		for _, certDomain := range x509Cert.DNSNames {
@@ -128,33 +268,31 @@ func loadTLSCert() tls.Certificate {
 				break
 			}
 		}
-		if !domainInCert || len(domainList) != len(x509Cert.DNSNames) {
-			// Domain is not in cert or cert contains a domain not in the domain
-			// list so generate and write new TLS certificate (but not key)
-			fmt.Println("- Generating new TLS certificate from TLS private key")
-			tlsCert, tlsKey := generateNewTLSCertFromKey(cert.PrivateKey)
-			fmt.Printf("- Writing TLS certificate to %s\n", configData.Gemini.TLS.CertPath)
-			writeTLSCert(tlsCert)
-			cert, err = tls.X509KeyPair(tlsCert, tlsKey)
-			handleErr(err, "Unable to load generated TLS certificate and key")
-			return cert
+		if !domainInCert {
+			return false
 		}
 	}
-	return cert
+	return true
 }
 
 // Write TLS certificate to config TLS certificate path
-func writeTLSCert(cert []byte) {
-	handleErr(os.WriteFile(configData.Gemini.TLS.CertPath, cert, 0600),
-		fmt.Sprintf("Unable to write TLS certificate file %s",
-			configData.Gemini.TLS.CertPath))
+func writeTLSCert(cert []byte) error {
+	if err := os.WriteFile(configData.Gemini.TLS.CertPath, cert,
+		0600); err != nil {
+		return fmt.Errorf("unable to write TLS certificate file %s: %w",
+			configData.Gemini.TLS.CertPath, err)
+	}
+	return nil
 }
 
 // Write TLS private key to config TLS key path
-func writeTLSKey(key []byte) {
-	handleErr(os.WriteFile(configData.Gemini.TLS.KeyPath, key, 0600),
-		fmt.Sprintf("Unable to write TLS key file %s",
-			configData.Gemini.TLS.KeyPath))
+func writeTLSKey(key []byte) error {
+	if err := writePrivateKeyFile(configData.Gemini.TLS.KeyPath,
+		key); err != nil {
+		return fmt.Errorf("unable to write TLS key file %s: %w",
+			configData.Gemini.TLS.KeyPath, err)
+	}
+	return nil
 }
 
 func publicKeyFromPrivateKey(privKey any) any {
@@ -171,13 +309,140 @@ func publicKeyFromPrivateKey(privKey any) any {
 }
 
 // Attempt to read TLS private key.  Returns private key if it exists and
-// is valid
-func getTLSKey() crypto.PrivateKey {
+// is valid.  Returns an error if the TLS private key is encrypted and can't
+// be decrypted
+func getTLSKey() (crypto.PrivateKey, error) {
 	keyBytes, err := os.ReadFile(configData.Gemini.TLS.KeyPath)
 	if err != nil {
-		return nil
+		return nil, nil
+	}
+	if isEncryptedData(keyBytes) {
+		keyBytes, err = readFileDecrypted(configData.Gemini.TLS.KeyPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 	privKeyPEM, _ := pem.Decode(keyBytes)
+	if privKeyPEM == nil {
+		return nil, nil
+	}
 	privKey, _ := x509.ParsePKCS8PrivateKey(privKeyPEM.Bytes)
-	return privKey
+	return privKey, nil
+}
+
+// Load TLS certificate and TLS private key from the config TLS paths,
+// decrypting the TLS private key if it is encrypted
+func loadTLSKeyPair() (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(configData.Gemini.TLS.CertPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readFileDecrypted(configData.Gemini.TLS.KeyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Generate a new TLS private key of the config TLS key type along with a
+// new self-signed TLS certificate and write both to the config TLS paths
+func regenerateTLSCertAndKey() error {
+	createFileDirectory(configData.Gemini.TLS.CertPath)
+	createFileDirectory(configData.Gemini.TLS.KeyPath)
+	logInfo("- Generating new %s TLS private key and TLS certificate",
+		getTLSKeyTypeOrDefault())
+	tlsCert, tlsKey, err := generateNewTLSCertAndKey()
+	if err != nil {
+		return err
+	}
+	logInfo("- Writing TLS certificate to %s", configData.Gemini.TLS.CertPath)
+	if err := writeTLSCert(tlsCert); err != nil {
+		return err
+	}
+	logInfo("- Writing TLS private key to %s", configData.Gemini.TLS.KeyPath)
+	return writeTLSKey(tlsKey)
+}
+
+// Get the config TLS key type or ed25519 if it is blank
+func getTLSKeyTypeOrDefault() string {
+	if configData.Gemini.TLS.KeyType == "" {
+		return TLS_KEY_TYPE_ED25519
+	}
+	return strings.ToLower(configData.Gemini.TLS.KeyType)
+}
+
+// Check if a self-signed TLS certificate expires within a tenth of its
+// validity period
+func tlsCertExpiresSoon(x509Cert *x509.Certificate) bool {
+	if x509Cert.CheckSignatureFrom(x509Cert) != nil {
+		// Not self-signed, so it is renewed by whoever issued it
+		return false
+	}
+	warnBefore := x509Cert.NotAfter.Sub(x509Cert.NotBefore) / 10
+	return time.Now().Add(warnBefore).After(x509Cert.NotAfter)
+}
+
+// Get the modification state of the config TLS certificate and key files
+func getTLSFileState() (state tlsFileState) {
+	if info, err := os.Stat(configData.Gemini.TLS.CertPath); err == nil {
+		state.certModTime = info.ModTime()
+		state.certSize = info.Size()
+	}
+	if info, err := os.Stat(configData.Gemini.TLS.KeyPath); err == nil {
+		state.keyModTime = info.ModTime()
+		state.keySize = info.Size()
+	}
+	return
+}
+
+// Set the TLS certificate used for new Gemini capsule connections
+func setGeminiTLSCert(cert tls.Certificate) {
+	geminiTLSCertLock.Lock()
+	defer geminiTLSCertLock.Unlock()
+	geminiTLSCert = &cert
+	geminiTLSCertFiles = getTLSFileState()
+}
+
+// Get the TLS certificate for a new Gemini capsule connection.  Used as
+// tls.Config GetCertificate so certificate reloads don't affect
+// connections that are already open
+func getGeminiTLSCert(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	geminiTLSCertLock.RLock()
+	defer geminiTLSCertLock.RUnlock()
+	if geminiTLSCert == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	return geminiTLSCert, nil
+}
+
+// Reload TLS certificate and key from the config TLS paths.  If the TLS
+// certificate and key can't be loaded, the current TLS certificate is kept.
+// If generateMissing is true, a new TLS certificate is generated when the
+// TLS certificate and key can't be loaded
+func reloadGeminiTLSCert(generateMissing bool) {
+	geminiTLSReloadLock.Lock()
+	defer geminiTLSReloadLock.Unlock()
+	cert, err := readTLSCert(generateMissing)
+	if err != nil {
+		logWarn("- Unable to reload TLS certificate, keeping current "+
+			"TLS certificate: %s", err)
+		return
+	}
+	setGeminiTLSCert(cert)
+	logInfo("- Reloaded TLS certificate")
+}
+
+// Reload TLS certificate when the TLS certificate or TLS key file changes
+func watchGeminiTLSCertFiles() {
+	for range time.Tick(TLS_FILE_WATCH_INTERVAL) {
+		geminiTLSCertLock.RLock()
+		loadedState := geminiTLSCertFiles
+		geminiTLSCertLock.RUnlock()
+		geminiTLSReloadLock.Lock()
+		fileState := getTLSFileState()
+		geminiTLSReloadLock.Unlock()
+		if fileState != loadedState {
+			reloadGeminiTLSCert(false)
+		}
+	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/ed25519"
 	"crypto/hmac"
@@ -10,23 +11,38 @@ import (
 	"encoding/base32"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	"filippo.io/edwards25519"
 	"golang.org/x/crypto/sha3"
+	"golang.org/x/term"
 )
 
 var (
-	torAddress               string
-	torControlConn           net.Conn
-	serverNonceRe            = regexp.MustCompile(" SERVERNONCE=([0-9A-Fa-f]+)")
-	serviceIDRe              = regexp.MustCompile("250-ServiceID=([2-7A-Za-z]+)")
-	torControlPortRe         = regexp.MustCompile("PORT=(.+)")
+	// Onion address and base64 expanded private key of the hidden service,
+	// both set once tor is started
+	torAddress              string
+	torHiddenServicePrivKey string
+	torAddressLock          sync.RWMutex
+	torControlConn          net.Conn
+	serverNonceRe           = regexp.MustCompile(" SERVERNONCE=([0-9A-Fa-f]+)")
+	serviceIDRe             = regexp.MustCompile("250-ServiceID=([2-7A-Za-z]+)")
+	torControlPortRe        = regexp.MustCompile("PORT=(.+)")
+	// torrc generated by bergelmir versions without the managed torrc
+	// marker, before bridges and pluggable transports could be configured
+	legacyTorrcRe = regexp.MustCompile("^SocksPort 0\n\nControlPort auto\n" +
+		"ControlPortWriteToFile [^\n]*\nCookieAuthFile [^\n]*\n" +
+		"CookieAuthentication 1\n$")
 	torControlServerNonce    []byte
 	torCmd                   *exec.Cmd
 	torConnected             chan bool
@@ -34,33 +50,95 @@ var (
 )
 
 const (
-	TOR_HMAC_SECRET = "Tor safe cookie authentication controller-to-server hash"
+	TOR_HMAC_SECRET                   = "Tor safe cookie authentication controller-to-server hash"
+	HIDDEN_SERVICE_V3_PRIV_KEY_HEADER = "== ed25519v1-secret: type0 ==\x00\x00\x00"
 )
 
 func getHiddenServiceV3PrivKey() string {
 	var privKey []byte
 	content, err := os.ReadFile(configData.Tor.HiddenServicePrivateKeyPath)
+	if err == nil && isEncryptedData(content) {
+		// Never replace a hidden service private key that can't be
+		// decrypted, as that would change the onion address
+		content, err = readFileDecrypted(
+			configData.Tor.HiddenServicePrivateKeyPath)
+		handleErr(err, "Unable to decrypt tor hidden service private key "+
+			configData.Tor.HiddenServicePrivateKeyPath)
+	}
+	if err == nil {
+		privKey, err = parseHiddenServiceV3PrivKeyFile(content)
+		if err != nil {
+			// Replacing the hidden service private key changes the onion
+			// address, so only do it if explicitly confirmed
+			confirmReplaceHiddenServiceV3PrivKey(err)
+		}
+	}
 	// If hidden_service_private_key_path is invalid or can't be read,
-	if err != nil || len(content) < 96 {
+	if err != nil {
 		var pubKey []byte
 		pubKey, privKey = generateHiddenServiceV3PubPrivKey()
 		createHiddenServiceV3PrivKeyFile(privKey)
-		torAddress = encodeHiddenServicePublicKey(pubKey)
+		setTorAddress(encodeHiddenServicePublicKey(pubKey))
 		// Generate tls cert for hidden service
 	} else {
-		privKey = content[32:96]
+		setTorAddress(encodeHiddenServicePublicKey(
+			hiddenServiceV3PubKey(privKey)))
 	}
 	return base64.StdEncoding.EncodeToString(privKey)
 }
 
-func createHiddenServiceV3PrivKeyFile(privKey []byte) {
-	keyFileContent := append([]byte("== ed25519v1-secret: type0 ==\x00\x00\x00"),
-		append(privKey, 0x0a)...)
-	err := os.WriteFile(configData.Tor.HiddenServicePrivateKeyPath,
-		keyFileContent, 0600)
+// Get the expanded private key from the content of a tor
+// hs_ed25519_secret_key file
+func parseHiddenServiceV3PrivKeyFile(content []byte) ([]byte, error) {
+	if len(content) < 96 {
+		return nil, fmt.Errorf("file is %d bytes instead of at least 96 bytes",
+			len(content))
+	}
+	if !bytes.HasPrefix(content, []byte(HIDDEN_SERVICE_V3_PRIV_KEY_HEADER)) {
+		return nil, errors.New("file does not start with the " +
+			"ed25519v1-secret header")
+	}
+	return content[32:96], nil
+}
+
+// Ask user to confirm replacing the corrupt hidden service private key
+// file.  Exits if not confirmed.  The corrupt file is kept next to the new
+// one so it can still be recovered
+func confirmReplaceHiddenServiceV3PrivKey(parseErr error) {
+	keyPath := configData.Tor.HiddenServicePrivateKeyPath
+	logWarn("- Tor hidden service private key %s is corrupt: %s", keyPath,
+		parseErr)
+	if !term.IsTerminal(int(os.Stdin.Fd())) ||
+		!getUserInputYN("", "Generate a new hidden service private key?  "+
+			"This changes the onion address [y/N]: ", false) {
+		handleErr(parseErr, "Refusing to replace corrupt tor hidden service "+
+			"private key "+keyPath+".  Restore it with `"+bergelmirCmd+
+			" identity import` or move it away to generate a new one")
+	}
+	corruptPath := keyPath + ".corrupt"
+	handleErr(os.Rename(keyPath, corruptPath),
+		"Unable to move corrupt tor hidden service private key to "+corruptPath)
+	logWarn("- Moved corrupt tor hidden service private key to %s",
+		corruptPath)
+}
+
+// Get the ed25519 public key of a tor hidden service expanded private key
+func hiddenServiceV3PubKey(privKey []byte) []byte {
+	// The first 32 bytes of the expanded private key are the clamped
+	// scalar (section A.2. of rend-spec-v3.txt)
+	scalar, err := new(edwards25519.Scalar).SetBytesWithClamping(privKey[:32])
 	if err != nil {
-		return
+		return nil
 	}
+	return new(edwards25519.Point).ScalarBaseMult(scalar).Bytes()
+}
+
+func createHiddenServiceV3PrivKeyFile(privKey []byte) {
+	keyFileContent := append([]byte(HIDDEN_SERVICE_V3_PRIV_KEY_HEADER),
+		append(privKey, 0x0a)...)
+	handleErr(writePrivateKeyFile(configData.Tor.HiddenServicePrivateKeyPath,
+		keyFileContent), "Unable to write tor hidden service private key "+
+		configData.Tor.HiddenServicePrivateKeyPath)
 }
 
 // Generate a Tor Hidden Service v3 Private Key using the method
@@ -80,15 +158,17 @@ func generateHiddenServiceV3PubPrivKey() (pubKey, privKey []byte) {
 	return pubKey, privKeyHash[:]
 }
 
-func getTorControlPort() (port string) {
+// Get the tor control port from the control port file that tor writes
+func getTorControlPort() (port string, err error) {
 	for i := 0; i < 5; i++ {
 		fileExists(configData.Tor.ControlPortFilePath)
 		time.Sleep(100 * time.Millisecond)
 	}
 	port = "127.0.0.1:9051"
 	controlPortFileContent, err := os.ReadFile(configData.Tor.ControlPortFilePath)
-	handleErr(err, "Unable to open tor control port file "+
-		configData.Tor.ControlPortFilePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to open tor control port file: %w", err)
+	}
 	torControlPortMatch := torControlPortRe.FindStringSubmatch(
 		string(controlPortFileContent))
 	if len(torControlPortMatch) > 1 {
@@ -98,7 +178,8 @@ func getTorControlPort() (port string) {
 }
 
 func connectToTor() (err error) {
-	torControlPort := getTorControlPort()
+	torControlPort, err := getTorControlPort()
+	handleErr(err, "Unable to find Tor control port")
 	torControlConn, err = net.Dial("tcp", torControlPort)
 	handleErr(err, "Unable to connect to Tor control port")
 	go readTorConn()
@@ -125,7 +206,7 @@ func readTorConn() {
 		case bytes.Contains(buf[:n], []byte("250-ServiceID=")):
 			torServiceIDMatch := serviceIDRe.FindStringSubmatch(string(buf[:n]))
 			if len(torServiceIDMatch) > 1 {
-				torAddress = torServiceIDMatch[1] + ".onion"
+				setTorAddress(torServiceIDMatch[1] + ".onion")
 				torConnected <- true
 				return
 			}
@@ -147,19 +228,127 @@ func torAuth() {
 	if err != nil {
 		return
 	}
+	authHash := torSafeCookieHash(cookieString, clientNonce,
+		torControlServerNonce)
+	torControlConn.Write([]byte("AUTHENTICATE " + hex.EncodeToString(authHash) + "\n"))
+	privKey := getHiddenServiceV3PrivKey()
+	torAddressLock.Lock()
+	torHiddenServicePrivKey = privKey
+	torAddressLock.Unlock()
+	torControlConn.Write([]byte(addOnionCommand(privKey)))
+}
+
+// Get the onion address of the hidden service, or "" if tor is not started
+func getTorAddress() string {
+	torAddressLock.RLock()
+	defer torAddressLock.RUnlock()
+	return torAddress
+}
+
+// Set the onion address of the hidden service
+func setTorAddress(address string) {
+	torAddressLock.Lock()
+	defer torAddressLock.Unlock()
+	torAddress = address
+}
+
+// Get the SAFECOOKIE authentication hash for the tor control port
+func torSafeCookieHash(cookie, clientNonce, serverNonce []byte) []byte {
 	authHmac := hmac.New(sha256.New, []byte(TOR_HMAC_SECRET))
-	authHmac.Write(cookieString)
+	authHmac.Write(cookie)
 	authHmac.Write(clientNonce)
-	authHmac.Write(torControlServerNonce)
-	torControlConn.Write([]byte("AUTHENTICATE " + hex.EncodeToString(authHmac.Sum(nil)) + "\n"))
-	privKey := getHiddenServiceV3PrivKey()
-	addOnionString := ("ADD_ONION ED25519-V3:" + privKey +
+	authHmac.Write(serverNonce)
+	return authHmac.Sum(nil)
+}
+
+// Get the ADD_ONION tor control command for the hidden service private key
+// with the Gemini capsule and HTTP server virtual ports
+func addOnionCommand(privKey string) string {
+	return ("ADD_ONION ED25519-V3:" + privKey +
 		" Flags=DiscardPK,Detach Port=" +
 		strconv.Itoa(configData.Gemini.Tor.VirtualPort) + "," +
 		configData.Gemini.ListeningLocation + " Port=" +
 		strconv.Itoa(configData.HTTP.Tor.VirtualPort) + "," +
 		configData.HTTP.ListeningLocation + "\n")
-	torControlConn.Write([]byte(addOnionString))
+}
+
+// Send a command to the tor control port and read the reply.  Returns an
+// error if the reply status is not 250
+func torControlCommand(conn net.Conn, reader *bufio.Reader,
+	command string) (reply string, err error) {
+	if _, err = conn.Write([]byte(command + "\r\n")); err != nil {
+		return
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return reply, err
+		}
+		reply += line
+		// The last line of a reply has a space after the status code
+		if len(line) >= 4 && line[3] == ' ' {
+			if line[:3] != "250" {
+				return reply, fmt.Errorf("%s", strings.TrimSpace(line))
+			}
+			return reply, nil
+		}
+	}
+}
+
+// Replace the onion service with one for the current Gemini capsule and
+// HTTP server listening locations and virtual ports.  The onion address
+// stays the same, but the new descriptor has to be published before the
+// onion service can be reached again
+func republishOnion() error {
+	port, err := getTorControlPort()
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("tcp", port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	clientNonce := make([]byte, 32)
+	rand.Read(clientNonce)
+	reply, err := torControlCommand(conn, reader,
+		"AUTHCHALLENGE SAFECOOKIE "+hex.EncodeToString(clientNonce))
+	if err != nil {
+		return err
+	}
+	serverNonceMatch := serverNonceRe.FindStringSubmatch(reply)
+	if len(serverNonceMatch) < 2 {
+		return fmt.Errorf("no server nonce in tor control port reply")
+	}
+	serverNonce, err := hex.DecodeString(serverNonceMatch[1])
+	if err != nil {
+		return err
+	}
+	cookie, err := os.ReadFile(configData.Tor.ControlAuthCookiePath)
+	if err != nil {
+		return err
+	}
+	authHash := torSafeCookieHash(cookie, clientNonce, serverNonce)
+	if _, err := torControlCommand(conn, reader,
+		"AUTHENTICATE "+hex.EncodeToString(authHash)); err != nil {
+		return err
+	}
+	// The private key loaded when tor started is reused, so a reload never
+	// reads, prompts for or replaces the hidden service private key file
+	torAddressLock.RLock()
+	address, privKey := torAddress, torHiddenServicePrivKey
+	torAddressLock.RUnlock()
+	if privKey == "" {
+		return fmt.Errorf("no hidden service private key loaded")
+	}
+	if _, err := torControlCommand(conn, reader,
+		"DEL_ONION "+strings.TrimSuffix(address, ".onion")); err != nil {
+		return err
+	}
+	_, err = torControlCommand(conn, reader, strings.TrimSuffix(
+		addOnionCommand(privKey), "\n"))
+	return err
 }
 
 func encodeHiddenServicePublicKey(pubKey []byte) string {
@@ -182,8 +371,130 @@ func encodeHiddenServicePublicKey(pubKey []byte) string {
 	}
 */
 
+// Default pluggable transport binary names for the transports bergelmir
+// knows about
+var defaultPluggableTransportBinaries = map[string][]string{
+	"obfs4":     {"lyrebird", "obfs4proxy"},
+	"meek_lite": {"lyrebird", "obfs4proxy"},
+	"snowflake": {"snowflake-client"},
+	"webtunnel": {"webtunnel-client", "lyrebird"},
+}
+
+// Get the pluggable transport name of a bridge line.  Returns an empty
+// string if the bridge line is a vanilla bridge (starts with an address)
+func bridgeLineTransport(bridgeLine string) string {
+	fields := strings.Fields(bridgeLine)
+	if len(fields) == 0 {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(fields[0]); err == nil {
+		return ""
+	}
+	return fields[0]
+}
+
+// Get the path of the default binary for a pluggable transport.  Returns
+// the first binary found in PATH, otherwise the first binary name
+func defaultPluggableTransportPath(transport string) string {
+	binaries, ok := defaultPluggableTransportBinaries[transport]
+	if !ok {
+		return ""
+	}
+	for _, binary := range binaries {
+		if path, err := exec.LookPath(binary); err == nil {
+			return path
+		}
+	}
+	return binaries[0]
+}
+
+// Generate torrc file content from the default torrc template and the
+// tor values in configData
+func generateTorrcContent() []byte {
+	torrcData := bytes.ReplaceAll(defaultTorrcFileContent,
+		[]byte("%COOKIE_AUTH_FILE%"),
+		[]byte(configData.Tor.ControlAuthCookiePath))
+	torrcData = bytes.ReplaceAll(torrcData, []byte("%CONTROL_PORT_FILE%"),
+		[]byte(configData.Tor.ControlPortFilePath))
+	bridgeConfig := ""
+	if configData.Tor.UseBridges {
+		bridgeConfig += "\nUseBridges 1\n"
+		for _, transport := range configData.Tor.PluggableTransports {
+			if len(transport.Transports) == 0 || transport.Path == "" {
+				continue
+			}
+			if torTransportCommandError(transport) != nil {
+				continue
+			}
+			// Quoted, so a # in the command is not a torrc comment
+			bridgeConfig += "ClientTransportPlugin " + torrcQuote(
+				strings.Join(transport.Transports, ",")+" exec "+
+					strings.Join(append([]string{transport.Path},
+						transport.Args...), " ")) + "\n"
+		}
+		for _, bridge := range configData.Tor.Bridges {
+			// Bridge lines with newlines would inject torrc options
+			bridge = strings.TrimSpace(strings.NewReplacer("\r", " ",
+				"\n", " ").Replace(bridge))
+			if bridge != "" {
+				bridgeConfig += "Bridge " + bridge + "\n"
+			}
+		}
+	}
+	return bytes.ReplaceAll(torrcData, []byte("%BRIDGE_CONFIG%\n"),
+		[]byte(bridgeConfig))
+}
+
+// Check that the pluggable transport command can be written to the torrc.
+// tor splits the command on spaces, so the path and arguments can't
+// contain whitespace
+func torTransportCommandError(transport ConfigTorTransport) error {
+	for _, arg := range append([]string{transport.Path}, transport.Args...) {
+		if strings.IndexFunc(arg, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r)
+		}) >= 0 {
+			return fmt.Errorf("%q contains whitespace or control characters",
+				arg)
+		}
+	}
+	return nil
+}
+
+// Quote a torrc option value
+func torrcQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) +
+		`"`
+}
+
+// Check if the torrc content was generated by bergelmir, so it can be
+// regenerated.  An unchanged torrc of an earlier version is regenerated
+// with the marker
+func isManagedTorrc(content []byte) bool {
+	marker, _, _ := bytes.Cut(defaultTorrcFileContent, []byte("\n"))
+	return bytes.HasPrefix(content, marker) || legacyTorrcRe.Match(content)
+}
+
+// Write torrc file generated from configData to torrc path, unless the
+// torrc exists and was edited by hand
+func writeTorrcFile() {
+	content, err := os.ReadFile(configData.Tor.TorrcPath)
+	if err == nil && !isManagedTorrc(content) {
+		if !bytes.Equal(content, generateTorrcContent()) {
+			logWarn("- Using hand-edited torrc %s, bridge and pluggable "+
+				"transport changes in the config file are not applied",
+				configData.Tor.TorrcPath)
+		}
+		return
+	}
+	createFileDirectory(configData.Tor.TorrcPath)
+	writeFile(configData.Tor.TorrcPath, generateTorrcContent())
+}
+
 // Start Tor
 func startTor() {
+	// Regenerate torrc so bridge and pluggable transport changes in
+	// config.yaml are used
+	writeTorrcFile()
 	torCmd = exec.Command("tor", "-f", configData.Tor.TorrcPath)
 	handleErr(torCmd.Start(), "Unable to start tor.  Is tor installed on "+
 		"your system?")